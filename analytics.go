@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Analytics Config
+const (
+	EVENT_COLLECTION       = "events"
+	ANALYTICS_BUFFER_SIZE  = 1000
+	ANALYTICS_BATCH_SIZE   = 100
+	ANALYTICS_FLUSH_PERIOD = time.Second
+)
+
+// Event types
+const (
+	EVENT_SEARCH = "search"
+	EVENT_CLICK  = "click"
+)
+
+// Event is one search or click of the user, tagged with the user's
+// experiment variant
+type Event struct {
+	ID         primitive.ObjectID `json:"-" bson:"_id,omitempty"`
+	Type       string             `json:"type" bson:"type"`
+	User       string             `json:"name" bson:"name"`
+	Experiment string             `json:"experiment,omitempty" bson:"experiment,omitempty"`
+	Variant    string             `json:"variant,omitempty" bson:"variant,omitempty"`
+	Mode       string             `json:"mode,omitempty" bson:"mode,omitempty"`
+	Query      string             `json:"query,omitempty" bson:"query,omitempty"`
+	DocumentId string             `json:"documentId,omitempty" bson:"documentId,omitempty"`
+	Promotion  string             `json:"promotion,omitempty" bson:"promotion,omitempty"`
+	Results    int                `json:"results" bson:"results"`
+	Time       time.Time          `json:"time" bson:"time"`
+}
+
+// The events are buffered and written in batches, so the request path
+// never waits for the analytics writes
+var eventBuffer = make(chan Event, ANALYTICS_BUFFER_SIZE)
+var droppedEvents uint64
+
+// recordEvent buffers the event, it's dropped when the buffer is full
+func recordEvent(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	select {
+	case eventBuffer <- e:
+	default:
+		atomic.AddUint64(&droppedEvents, 1)
+		log.WithFields(
+			logrus.Fields{
+				"type": e.Type,
+			}).Warn("analytics buffer is full, event dropped")
+	}
+}
+
+// runAnalyticsWriter writes the buffered events in batches until the
+// context is done, and flushes the rest of the buffer before returning
+func runAnalyticsWriter(ctx context.Context) {
+	ticker := time.NewTicker(ANALYTICS_FLUSH_PERIOD)
+	defer ticker.Stop()
+
+	batch := make([]interface{}, 0, ANALYTICS_BATCH_SIZE)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := writeEvents(batch); err != nil {
+			atomic.AddUint64(&droppedEvents, uint64(len(batch)))
+			log.WithFields(
+				logrus.Fields{
+					"events": len(batch),
+					"err":    err,
+				}).Error("write analytics events failed")
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case e := <-eventBuffer:
+			batch = append(batch, e)
+			if len(batch) == ANALYTICS_BATCH_SIZE {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-ctx.Done():
+			for {
+				select {
+				case e := <-eventBuffer:
+					batch = append(batch, e)
+					if len(batch) == ANALYTICS_BATCH_SIZE {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+func writeEvents(batch []interface{}) error {
+	ctx, cancel := withDeadline(context.Background(), config.Timeouts.ReportMs)
+	defer cancel()
+	client, err := GetMongoClient(ctx)
+	if err != nil {
+		return err
+	}
+	collection := client.Database(DB).Collection(EVENT_COLLECTION)
+	_, err = collection.InsertMany(ctx, batch)
+	return err
+}
+
+// The index of the users' events, read by the experiment report and the
+// tag learner
+var eventUserIndexOnce sync.Once
+
+func ensureEventUserIndex(ctx context.Context, collection *mongo.Collection) {
+	eventUserIndexOnce.Do(func() {
+		model := mongo.IndexModel{Keys: bson.D{{"name", 1}, {"type", 1}, {"time", -1}}}
+		if _, err := collection.Indexes().CreateOne(ctx, model); err != nil {
+			log.WithContext(ctx).WithFields(
+				logrus.Fields{
+					"err": err,
+				}).Error("create the events user index failed")
+		}
+	})
+}
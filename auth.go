@@ -0,0 +1,388 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Auth Config
+const (
+	API_KEY_COLLECTION  = "api_keys"
+	API_KEY_HEADER      = "X-API-Key"
+	API_KEY_ID_BYTES    = 4
+	API_KEY_BYTES       = 32
+	API_KEY_MAX_UNKNOWN = 10000
+)
+
+// Roles of the API keys
+const (
+	ROLE_SHOPPER      = "shopper"      // the shop front ends, their own rate limit budget
+	ROLE_MERCHANDISER = "merchandiser" // tunes the search, reads the debug scores
+	ROLE_ANALYST      = "analyst"      // reads the experiment reports and the debug scores
+	ROLE_ADMIN        = "admin"        // every route
+)
+
+var roles = []string{ROLE_SHOPPER, ROLE_MERCHANDISER, ROLE_ANALYST, ROLE_ADMIN}
+
+// errInvalidKey is a malformed, unknown or revoked API key
+var errInvalidKey = errors.New("invalid API key")
+
+// APIKey is an issued key. The key is "<id>.<secret>" and only its SHA-256
+// hash is stored, the key itself is shown once when it's issued
+type APIKey struct {
+	ID        string     `json:"id" bson:"_id"`
+	Hash      string     `json:"-" bson:"hash"`
+	Name      string     `json:"name" bson:"name"`
+	Role      string     `json:"role" bson:"role"`
+	CreatedAt time.Time  `json:"createdAt" bson:"createdAt"`
+	RevokedAt *time.Time `json:"revokedAt,omitempty" bson:"revokedAt,omitempty"`
+}
+
+// allows tells if the key's role is one of the roles, admin is allowed
+// everywhere
+func (k *APIKey) allows(roles ...string) bool {
+	if k.Role == ROLE_ADMIN {
+		return true
+	}
+	for _, role := range roles {
+		if k.Role == role {
+			return true
+		}
+	}
+	return false
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// apiKeyCache keeps the looked up keys for cacheSeconds, so a revoked key
+// is refused at most cacheSeconds later, and the unknown ids for
+// unknownCacheSeconds
+type apiKeyCache struct {
+	mu      sync.Mutex
+	keys    map[string]cachedAPIKey
+	unknown map[string]time.Time
+}
+
+type cachedAPIKey struct {
+	key     *APIKey
+	fetched time.Time
+}
+
+var apiKeys = &apiKeyCache{keys: map[string]cachedAPIKey{}, unknown: map[string]time.Time{}}
+
+// lookup gets the key of the id, nil when there's none
+func (c *apiKeyCache) lookup(ctx context.Context, id string) (*APIKey, error) {
+	ttl := time.Duration(config.Auth.CacheSeconds) * time.Second
+	unknownTTL := time.Duration(config.Auth.UnknownCacheSeconds) * time.Second
+	c.mu.Lock()
+	cached, ok := c.keys[id]
+	missed, unknown := c.unknown[id]
+	c.mu.Unlock()
+	if ok && time.Since(cached.fetched) < ttl {
+		return cached.key, nil
+	}
+	if unknown && time.Since(missed) < unknownTTL {
+		return nil, nil
+	}
+
+	client, err := GetMongoClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := withDeadline(ctx, config.Auth.LookupMs)
+	defer cancel()
+	key := &APIKey{}
+	err = client.Database(DB).Collection(API_KEY_COLLECTION).FindOne(ctx, bson.M{"_id": id}).Decode(key)
+	if err == mongo.ErrNoDocuments {
+		key, err = nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if key != nil {
+		c.keys[id] = cachedAPIKey{key: key, fetched: time.Now()}
+		delete(c.unknown, id)
+		return key, nil
+	}
+	// The unknown ids are bounded, a flood of made up ones could fill the
+	// memory. The expired ones make room, else the id isn't remembered
+	if len(c.unknown) >= API_KEY_MAX_UNKNOWN {
+		for k, t := range c.unknown {
+			if time.Since(t) >= unknownTTL {
+				delete(c.unknown, k)
+			}
+		}
+	}
+	if len(c.unknown) < API_KEY_MAX_UNKNOWN {
+		c.unknown[id] = time.Now()
+	}
+	return nil, nil
+}
+
+// verifyAPIKey gets the issued, unrevoked key of the presented one
+func verifyAPIKey(ctx context.Context, presented string) (*APIKey, error) {
+	id, _, ok := strings.Cut(presented, ".")
+	if !ok || id == "" {
+		return nil, errInvalidKey
+	}
+	key, err := apiKeys.lookup(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil || key.RevokedAt != nil ||
+		subtle.ConstantTimeCompare([]byte(key.Hash), []byte(hashAPIKey(presented))) != 1 {
+		return nil, errInvalidKey
+	}
+	return key, nil
+}
+
+type apiKeyKey struct{}
+
+// apiKeyFrom is the verified key of the request, nil for anonymous ones
+func apiKeyFrom(ctx context.Context) *APIKey {
+	key, _ := ctx.Value(apiKeyKey{}).(*APIKey)
+	return key
+}
+
+// presentedAPIKey reads the X-API-Key header, or the bearer token of the
+// Authorization header
+func presentedAPIKey(r *http.Request) string {
+	if key := r.Header.Get(API_KEY_HEADER); key != "" {
+		return key
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	return ""
+}
+
+// The invalid keys of every client IP, guessing keys is throttled
+var authFailures = newMemoryLimiter()
+
+// authenticate verifies the API key of the requests presenting one, and
+// answers 401 to the invalid ones. An IP which sent more invalid keys than
+// the failures budget gets 429 without its key being checked. The requests
+// without a key stay anonymous
+func authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		presented := presentedAPIKey(r)
+		if !config.Auth.Enabled || presented == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ip := clientIP(r)
+		budget := config.Auth.Failures
+		if budget.RatePerSecond > 0 {
+			if wait := authFailures.wait(ip, budget); wait > 0 {
+				rateLimited.WithLabelValues(RATE_AUTH).Inc()
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				http.Error(w, "Too many invalid API keys", http.StatusTooManyRequests)
+				return
+			}
+		}
+		key, err := verifyAPIKey(r.Context(), presented)
+		if err == errInvalidKey {
+			if budget.RatePerSecond > 0 {
+				authFailures.Allow(r.Context(), ip, budget)
+			}
+			if sampled("invalid API key refused") {
+				log.WithContext(r.Context()).WithFields(
+					logrus.Fields{
+						"ip": ip,
+					}).Warn("invalid API key refused")
+			}
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Invalid API key", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			dbFailed(w, r, "Error checking API key", err)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiKeyKey{}, key)))
+	})
+}
+
+// authorize answers 401 to the anonymous requests and 403 to the keys
+// without one of the roles, it tells if the request may go on
+func authorize(w http.ResponseWriter, r *http.Request, roles ...string) bool {
+	if !config.Auth.Enabled {
+		return true
+	}
+	key := apiKeyFrom(r.Context())
+	if key == nil {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "API key required", http.StatusUnauthorized)
+		return false
+	}
+	if !key.allows(roles...) {
+		log.WithContext(r.Context()).WithFields(
+			logrus.Fields{
+				"key":  key.ID,
+				"role": key.Role,
+				"path": r.URL.Path,
+			}).Warn("API key role refused")
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// requireRole only serves the requests authenticated with one of the
+// roles, or admin
+func requireRole(next http.HandlerFunc, roles ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if authorize(w, r, roles...) {
+			next(w, r)
+		}
+	}
+}
+
+// issueAPIKey creates a key of the role, and returns it with the key to
+// hand over
+func issueAPIKey(ctx context.Context, name, role string) (*APIKey, string, error) {
+	valid := false
+	for _, r := range roles {
+		valid = valid || r == role
+	}
+	if !valid {
+		return nil, "", fmt.Errorf("unknown role %q, use %s", role, strings.Join(roles, ", "))
+	}
+	client, err := GetMongoClient(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+
+	id := make([]byte, API_KEY_ID_BYTES)
+	secret := make([]byte, API_KEY_BYTES)
+	if _, err := rand.Read(id); err != nil {
+		return nil, "", err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", err
+	}
+	presented := hex.EncodeToString(id) + "." + hex.EncodeToString(secret)
+	key := &APIKey{
+		ID:        hex.EncodeToString(id),
+		Hash:      hashAPIKey(presented),
+		Name:      name,
+		Role:      role,
+		CreatedAt: time.Now(),
+	}
+	if _, err := client.Database(DB).Collection(API_KEY_COLLECTION).InsertOne(ctx, key); err != nil {
+		return nil, "", err
+	}
+	return key, presented, nil
+}
+
+// revokeAPIKey revokes the key of the id, the servers refuse it once their
+// cached copy expires
+func revokeAPIKey(ctx context.Context, id string) error {
+	client, err := GetMongoClient(ctx)
+	if err != nil {
+		return err
+	}
+	res, err := client.Database(DB).Collection(API_KEY_COLLECTION).UpdateOne(ctx,
+		bson.M{"_id": id, "revokedAt": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"revokedAt": time.Now()}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return fmt.Errorf("no unrevoked key %q", id)
+	}
+	return nil
+}
+
+// listAPIKeys lists the issued keys, oldest first
+func listAPIKeys(ctx context.Context) ([]APIKey, error) {
+	client, err := GetMongoClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cursor, err := client.Database(DB).Collection(API_KEY_COLLECTION).Find(ctx, bson.M{},
+		options.Find().SetSort(bson.D{{"createdAt", 1}}))
+	if err != nil {
+		return nil, err
+	}
+	keys := []APIKey{}
+	if err = cursor.All(ctx, &keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// apikeyCommand issues, revokes and lists the API keys
+func apikeyCommand(args []string) error {
+	if len(args) == 0 || (args[0] != "issue" && args[0] != "revoke" && args[0] != "list") {
+		return fmt.Errorf("usage: apikey issue -name name -role role | revoke -id id | list")
+	}
+	action := args[0]
+	fs := flag.NewFlagSet("apikey "+action, flag.ExitOnError)
+	name := fs.String("name", "", "who or what the key is for")
+	role := fs.String("role", "", strings.Join(roles, ", "))
+	id := fs.String("id", "", "id of the revoked key")
+	fs.Parse(args[1:])
+
+	ctx := context.Background()
+	switch action {
+	case "issue":
+		if *name == "" {
+			return fmt.Errorf("the -name is required")
+		}
+		key, presented, err := issueAPIKey(ctx, *name, *role)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("issued %s key %s for %s, it's only shown once:\n%s\n", key.Role, key.ID, key.Name, presented)
+	case "revoke":
+		if *id == "" {
+			return fmt.Errorf("the -id is required")
+		}
+		if err := revokeAPIKey(ctx, *id); err != nil {
+			return err
+		}
+		fmt.Printf("revoked %s\n", *id)
+	case "list":
+		keys, err := listAPIKeys(ctx)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tROLE\tCREATED\tREVOKED")
+		for _, k := range keys {
+			revoked := "-"
+			if k.RevokedAt != nil {
+				revoked = k.RevokedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", k.ID, k.Name, k.Role, k.CreatedAt.Format(time.RFC3339), revoked)
+		}
+		w.Flush()
+	}
+	return nil
+}
@@ -3,27 +3,36 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"io"
 	"net/http"
 	"os"
-	"strconv"
+	"os/signal"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/sync/singleflight"
 )
 
 // Global client instance
 var clientInstance *mongo.Client
 var log *logrus.Logger
 
-// Used for creating a singleton client instance
+// Used for creating a singleton client instance, the failed connections are
+// retried after the backoff. mongoMu only guards the state, the connection
+// is made outside of it
 var clientInstanceError error
-var mongoOnce sync.Once
+var mongoMu sync.Mutex
+var mongoConnect singleflight.Group
+var mongoBackoff time.Duration
+var mongoRetryAt time.Time
 
 // Database Config
 const (
@@ -33,8 +42,21 @@ const (
 	CUSTOMER_COLLECTION         = "customers"
 	SEARCH_REPORT_COLLECTION    = "searchs"
 	MARKETING_CONFIG_COLLECTION = "marketing_config"
+	SEARCH_INDEX                = "item_search2"
 )
 
+// User Config
+const (
+	DEFAULT_USER        = "benjamin"
+	USER_HEADER         = "X-User-Name"
+	MAX_SEARCH_HISTORY  = 50
+	MAX_VIEW_HISTORY    = 20
+	HISTORY_BUFFER_SIZE = 1000
+)
+
+// SEARCH_QUERY_LOG is the message of the sampled served queries log
+const SEARCH_QUERY_LOG = "search query served"
+
 // ItemReport is the web page post item
 // for reporting user's click behavior
 type ItemReport struct {
@@ -45,15 +67,37 @@ type ItemReport struct {
 	ViewTime time.Time `json:"viewTime" bson:"viewTime"`
 }
 
-// QueryReport is the user input search query, search time and
-// total search this keyword counts, next page, previous page will
+// Validate checks the reported click, the view time is set by the server
+func (c *ItemReport) Validate(v *validator) {
+	if strings.TrimSpace(c.DocumentId) == "" {
+		v.fail("documentId", "is required")
+	}
+	v.text("documentId", c.DocumentId, config.Limits.MaxFieldLength)
+	v.text("name", c.Name, config.Limits.MaxFieldLength)
+	v.text("name2", c.Name2, config.Limits.MaxFieldLength)
+}
+
+// QueryReport is the user input search query, its latest search time and
+// how many times it's in the user's history, next page, previous page will
 // calculate into one search operation
 type QueryReport struct {
-	ID         primitive.ObjectID `bson:"_id,omitempty"`
-	User       string             `json:"name" bson:"name"`
-	Query      string             `json:"query" bson:"query"`
-	SearchTime time.Time          `json:"searchTime" bson:"searchTime"`
-	Count      int                `json:"count" bson:"count"`
+	User       string    `json:"name" bson:"name"`
+	Query      string    `json:"query" bson:"query"`
+	SearchTime time.Time `json:"searchTime" bson:"searchTime"`
+	Count      int       `json:"count" bson:"count"`
+}
+
+// SearchHistory is the searchs document of the user, with the latest
+// MAX_SEARCH_HISTORY searches, oldest first
+type SearchHistory struct {
+	User     string          `bson:"name"`
+	Searches []SearchedQuery `bson:"searches"`
+}
+
+// SearchedQuery is one search of the user's history
+type SearchedQuery struct {
+	Query      string    `bson:"query"`
+	SearchTime time.Time `bson:"searchTime"`
 }
 
 // PromotionConfig stores company product operator's promotion configurations
@@ -66,66 +110,281 @@ type PromotionConfig struct {
 	EndDate           time.Time          `json:"endDate" bson:"endDate"`
 }
 
-// Results are BSON array object, contains search items
-type Results []bson.M
+// Results are the typed search items of the responses
+type Results []SearchHit
 
 type SearchRsp struct {
 	SearchResults       Results `json:"searchResults"`
 	MoreLikeThisResults Results `json:"moreLikeThisResults"`
+	Variant             string  `json:"variant,omitempty"`
+	// Partial is set when a retrieval timed out or failed, and the response
+	// has only the results of the others
+	Partial bool `json:"partial,omitempty"`
+	// Degraded are the optional retrievals which failed
+	Degraded []string `json:"degraded,omitempty"`
+}
+
+// Search modes
+const (
+	MODE_SEARCH       = "search"
+	MODE_PERSONALIZED = "search-p"
+	MODE_MARKETING    = "search-m"
+)
+
+// SearchOptions are the per request knobs of the search modes
+type SearchOptions struct {
+	Debug  bool
+	Blend  string
+	Boosts FieldBoosts
+}
+
+// defaultSearchOptions gets the configured options of the search mode
+func defaultSearchOptions(mode string) SearchOptions {
+	opts := SearchOptions{Blend: config.Blend.Strategy}
+	switch mode {
+	case MODE_PERSONALIZED:
+		opts.Boosts = config.Boosts.Personalized
+	case MODE_MARKETING:
+		opts.Boosts = config.Boosts.Marketing
+	default:
+		opts.Boosts = config.Boosts.Search
+	}
+	return opts
+}
+
+// textClauses are one text clause for every boosted path, the zero boosted
+// paths are left out
+func textClauses(query string, boosts FieldBoosts) bson.A {
+	should := bson.A{}
+	for _, path := range boosts.Paths() {
+		should = append(should, bson.D{{"text", bson.D{{"query", query}, {"path", path}, {"score", bson.D{{"boost", bson.D{{"value", boosts[path]}}}}}}}})
+	}
+	return should
 }
 
 func main() {
-	file, err := os.OpenFile("logrus.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	var err error
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		if config, err = loadConfig(path); err != nil {
+			logrus.WithFields(
+				logrus.Fields{
+					"path": path,
+					"err":  err,
+				}).Fatal("load config file failed")
+		}
+	}
+
+	// Set up logrus with the configured level, format and sinks
+	closeLog, err := setupLogging()
+	if err != nil {
+		logrus.WithFields(
+			logrus.Fields{
+				"err": err,
+			}).Fatal("set up logging failed")
+	}
+	defer closeLog()
+
+	// Run the CLI command instead of the server, e.g. go run . eval
+	if len(os.Args) > 1 {
+		runCommand(os.Args[1], os.Args[2:])
+		return
+	}
+
+	// Stop on SIGTERM or Ctrl-C
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// Trace the requests before the first MongoDB command
+	shutdownTracing, err := setupTracing(ctx)
 	if err != nil {
-		logrus.Fatal("Failed to log to file, using default stderr")
+		log.WithFields(
+			logrus.Fields{
+				"err": err,
+			}).Fatal("set up tracing failed")
 	}
-	defer file.Close()
 
-	// Set up logrus
-	log = logrus.New()
-	log.Out = file
+	// Wait for MongoDB, a short outage at startup shouldn't fail the checks
+	connectCtx, cancel := context.WithTimeout(ctx, time.Duration(config.Server.ConnectSeconds)*time.Second)
+	waitForMongo(connectCtx)
+	cancel()
+
+	// Check the collections and the search index before serving
+	runStartupChecks(ctx)
+
+	// The background workers outlive the signal until the in-flight
+	// requests are drained
+	workerCtx, stopWorkers := context.WithCancel(context.Background())
+
+	// Learn the customers' tags from their clicks in the background
+	startWorker(workerCtx, runTagLearner)
+	startWorker(workerCtx, runAnalyticsWriter)
+	startWorker(workerCtx, runHistoryWriter)
+	startWorker(workerCtx, runPromotionCache)
+	startWorker(workerCtx, runSearchRecheck)
+
+	// Keep the caches and the derived item fields in sync with the catalog
+	startWorker(workerCtx, func(ctx context.Context) { runCatalogWatcher(ctx, COLLECTION) })
+	startWorker(workerCtx, func(ctx context.Context) { runCatalogWatcher(ctx, MARKETING_CONFIG_COLLECTION) })
+
+	// Limit the expensive searches and the writes per client
+	if limiter, err = newRateLimiter(); err != nil {
+		log.WithFields(
+			logrus.Fields{
+				"err": err,
+			}).Fatal("set up rate limiting failed")
+	}
 
 	// Serve static files from the 'html' directory
 	fs := http.FileServer(http.Dir("./html"))
 	http.Handle("/", fs)
 
 	// Handle /items for GET list requests
-	http.HandleFunc("/items", itemsHandler)
-	http.HandleFunc("/report-click", reportHandler)
-	http.HandleFunc("/search", searchHandler)
-	http.HandleFunc("/search-p", personalizedSearchHandler)
-	http.HandleFunc("/search-m", marketingSearchHandler) // supporting company operator recommending items or keywords
-
-	// Start the server
-	http.ListenAndServe(":8080", nil)
-}
-
-// GetMongoClient is a function to create a singleton client instance.
-func GetMongoClient() (*mongo.Client, error) {
-	// Perform the client creation process only once.
-	mongoOnce.Do(func() {
-		clientOptions := options.Client().ApplyURI(CONNECTIONSTRING)
-		client, err := mongo.Connect(context.TODO(), clientOptions)
-		if err != nil {
-			clientInstanceError = err
-			return
+	http.HandleFunc("/items", instrument("/items", "none", rateLimit(RATE_SEARCH, itemsHandler)))
+	http.HandleFunc("/report-click", instrument("/report-click", "none", rateLimit(RATE_CLICK, reportHandler)))
+	http.HandleFunc("/search", instrument("/search", MODE_SEARCH, rateLimit(RATE_SEARCH, requireSearch(searchHandler))))
+	http.HandleFunc("/search-p", instrument("/search-p", MODE_PERSONALIZED, rateLimit(RATE_SEARCH, requireSearch(personalizedSearchHandler))))
+	http.HandleFunc("/search-m", instrument("/search-m", MODE_MARKETING, rateLimit(RATE_SEARCH, requireSearch(marketingSearchHandler)))) // supporting company operator recommending items or keywords
+	http.HandleFunc("/search-x", instrument("/search-x", MODE_SEARCH, rateLimit(RATE_SEARCH, requireSearch(experimentSearchHandler))))   // the /search of the first experiments
+	http.HandleFunc("/me/searches", instrument("/me/searches", "none", rateLimit(RATE_SEARCH, searchHistoryHandler)))
+	http.HandleFunc("/experiments/report", requireRole(rateLimit(RATE_ADMIN, experimentReportHandler), ROLE_ANALYST, ROLE_MERCHANDISER))
+	http.HandleFunc("/cache/stats", requireRole(rateLimit(RATE_ADMIN, cacheStatsHandler), ROLE_ADMIN))
+	// The metrics show the traffic and the errors, Prometheus scrapes them
+	// with an admin key as its bearer token
+	http.HandleFunc("/metrics", requireRole(promhttp.Handler().ServeHTTP, ROLE_ADMIN))
+
+	// Probes of the orchestrator and the load balancers
+	http.HandleFunc("/healthz", healthzHandler)
+	http.HandleFunc("/readyz", rateLimit(RATE_PROBE, readyzHandler))
+	http.HandleFunc("/status", requireRole(statusHandler, ROLE_ADMIN))
+
+	// Start the server, it drains the requests and flushes the analytics on
+	// shutdown
+	server := &http.Server{Addr: ":8080", Handler: traceHandler(withRequestID(authenticate(http.DefaultServeMux)))}
+	if err := serve(ctx, server, stopWorkers); err != nil {
+		log.WithFields(
+			logrus.Fields{
+				"err": err,
+			}).Error("server stopped")
+	}
+
+	// Flush the buffered spans
+	flushCtx, cancel := context.WithTimeout(context.Background(), time.Duration(config.Server.ShutdownSeconds)*time.Second)
+	defer cancel()
+	if err := shutdownTracing(flushCtx); err != nil {
+		log.WithFields(
+			logrus.Fields{
+				"err": err,
+			}).Error("flush the spans failed")
+	}
+}
+
+// GetMongoClient is a function to create a singleton client instance. A
+// failed connection is retried on the next call after the backoff, which
+// doubles with every failure. The concurrent callers share one connection
+// attempt, and each stops waiting for it when its context is done
+func GetMongoClient(ctx context.Context) (*mongo.Client, error) {
+	mongoMu.Lock()
+	client, retryAt, lastErr := clientInstance, mongoRetryAt, clientInstanceError
+	mongoMu.Unlock()
+	if client != nil {
+		return client, nil
+	}
+	if time.Now().Before(retryAt) {
+		return nil, lastErr
+	}
+
+	// The attempt isn't bound to the first caller's context, the others
+	// share it
+	connecting := mongoConnect.DoChan("connect", func() (interface{}, error) {
+		return connectMongoOnce()
+	})
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res := <-connecting:
+		if res.Err != nil {
+			return nil, res.Err
 		}
-		// Check the connection
-		err = client.Ping(context.TODO(), nil)
-		if err != nil {
-			clientInstanceError = err
-			return
+		return res.Val.(*mongo.Client), nil
+	}
+}
+
+// connectMongoOnce connects unless another attempt just did, and records the
+// client or the failure and its backoff
+func connectMongoOnce() (*mongo.Client, error) {
+	mongoMu.Lock()
+	if clientInstance != nil {
+		defer mongoMu.Unlock()
+		return clientInstance, nil
+	}
+	mongoMu.Unlock()
+
+	client, err := connectMongo()
+
+	mongoMu.Lock()
+	defer mongoMu.Unlock()
+	if err != nil {
+		clientInstanceError = err
+		mongoBackoff *= 2
+		if mongoBackoff < MONGO_BACKOFF_MIN {
+			mongoBackoff = MONGO_BACKOFF_MIN
 		}
-		clientInstance = client
-	})
-	return clientInstance, clientInstanceError
+		if mongoBackoff > MONGO_BACKOFF_MAX {
+			mongoBackoff = MONGO_BACKOFF_MAX
+		}
+		mongoRetryAt = time.Now().Add(mongoBackoff)
+		log.WithFields(
+			logrus.Fields{
+				"retryIn": mongoBackoff.String(),
+				"err":     err,
+			}).Error("connect to MongoDB failed")
+		return nil, err
+	}
+	clientInstance, clientInstanceError, mongoBackoff = client, nil, 0
+	return clientInstance, nil
+}
+
+// aggregateItems runs the pipeline in the span of the search stage
+func aggregateItems(ctx context.Context, stage string, collection *mongo.Collection, p []bson.D) (results []bson.M, err error) {
+	ctx, span := startSpan(ctx, stage, attribute.Int("pipeline.stages", len(p)))
+	defer func() {
+		span.SetAttributes(attribute.Int("results", len(results)))
+		endSpan(span, err)
+	}()
+
+	cursor, err := collection.Aggregate(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	if err = cursor.All(ctx, &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// currentUser gets the visitor's name from the request header, the demo
+// falls back to the default user
+func currentUser(r *http.Request) string {
+	if user := r.Header.Get(USER_HEADER); user != "" {
+		return user
+	}
+	return DEFAULT_USER
+}
+
+// authorizeUser lets the anonymous requests act for the default user only,
+// a front end acting for its shoppers needs a shopper key. So nobody reads
+// or writes the profile, clicks and search history of another user
+func authorizeUser(w http.ResponseWriter, r *http.Request, user string) bool {
+	return user == DEFAULT_USER || authorize(w, r, ROLE_SHOPPER)
 }
 
-func getItemList(skip int) Results {
-	client, err := GetMongoClient()
+func getItemList(ctx context.Context, skip int) (Results, error) {
+	client, err := GetMongoClient(ctx)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
+	ctx, cancel := withDeadline(ctx, config.Timeouts.ItemsMs)
+	defer cancel()
 
 	// Specify the collection
 	collection := client.Database(DB).Collection(COLLECTION)
@@ -135,19 +394,7 @@ func getItemList(skip int) Results {
 	//groupStage := bson.D{{"$group", bson.D{{"_id", "$field"}, {"total", bson.D{{"$sum", "$field"}}}}}} // Replace as needed
 	sortStage := bson.D{{"$sort", bson.D{{"documentId", -1}}}} // Replace "field" and "value" with your actual parameters
 	limitStage := bson.D{{"$limit", 10}}
-	projectStage := bson.D{
-		{
-			Key: "$project", Value: bson.D{
-				{"_id", 0},
-				{"name", 1},
-				{"name2", 1},
-				{"price", 1},
-				{"imageUrl", 1},
-				{"imageUrl2", 1},
-				{"documentId", 1},
-			},
-		},
-	}
+	projectStage := bson.D{{"$project", itemProjection()}}
 	skipStage := bson.D{{"$skip", (skip - 1) * 10}}
 	// Modify according to your needs
 	pipe := mongo.Pipeline{sortStage, limitStage, projectStage}
@@ -156,27 +403,29 @@ func getItemList(skip int) Results {
 		pipe = mongo.Pipeline{sortStage, skipStage, limitStage, projectStage}
 	}
 
-	cursor, err := collection.Aggregate(context.TODO(), pipe)
+	results, err := aggregateItems(ctx, "items.list", collection, pipe)
 	if err != nil {
-		log.Fatal(err)
-	}
-	var results []bson.M
-	if err = cursor.All(context.Background(), &results); err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	log.Info(results)
-	return results
+	log.WithContext(ctx).WithFields(
+		logrus.Fields{
+			"page":  skip,
+			"count": len(results),
+		}).Debug("listed items")
+	return toResults(results), nil
 }
 
 func itemsHandler(w http.ResponseWriter, r *http.Request) {
-	// Handle search queries
-	pageNum := r.URL.Query().Get("page")
-	// If a query exists, filter items
-	page, err := strconv.Atoi(pageNum)
+	v := &validator{}
+	page := v.page(r)
+	if v.reject(w) {
+		return
+	}
+	items, err := getItemList(r.Context(), page)
 	if err != nil {
-		page = 0
+		dbFailed(w, r, "Error getting items", err)
+		return
 	}
-	items := getItemList(page)
 
 	// Convert the data to JSON
 	jsonData, err := json.Marshal(items)
@@ -192,67 +441,48 @@ func itemsHandler(w http.ResponseWriter, r *http.Request) {
 
 // reportHandler reports the user's click behavior in the list page
 func reportHandler(w http.ResponseWriter, r *http.Request) {
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, "Error reading request body", http.StatusInternalServerError)
+	v := &validator{}
+	user := v.user(r)
+	var click ItemReport
+	if v.decodeJSON(w, r, &click) {
+		click.Validate(v)
+	}
+	if v.reject(w) {
 		return
 	}
-
-	// It's a good practice to close the body when you're done with it
-	defer r.Body.Close()
-
-	client, err := GetMongoClient()
-	if err != nil {
-		log.Fatal(err)
+	if !authorizeUser(w, r, user) {
+		return
 	}
-	collection := client.Database(DB).Collection(CUSTOMER_COLLECTION)
 
-	// Print the body to the server's console
-	log.Info("Received request with body:", string(body))
-	var click ItemReport
-	err = json.Unmarshal(body, &click)
+	ctx, cancel := withDeadline(r.Context(), config.Timeouts.ReportMs)
+	defer cancel()
+	client, err := GetMongoClient(ctx)
 	if err != nil {
-		log.WithFields(
-			logrus.Fields{
-				"body": body,
-				"err":  err,
-			},
-		).Fatal("unmarshal the click report with error input body failed")
+		dbFailed(w, r, "Error connecting to DB", err)
+		return
 	}
+	collection := client.Database(DB).Collection(CUSTOMER_COLLECTION)
 
 	click.ViewTime = time.Now()
+	recordClick(user, click)
 
-	// get the user doc from mongoDB
-	var doc bson.M
-	if err := collection.FindOne(context.TODO(), bson.M{"name": "benjamin"}).Decode(&doc); err != nil {
-		log.Fatal(err)
-	}
-
-	clicks := doc["viewHistory"].(bson.A) // Change "clicks" to the actual field name of the array.
-	clicks = append(clicks, click)
-
-	// Step 3: Make sure the limitation (FIFO).
-	if len(clicks) > 20 {
-		clicks = clicks[len(clicks)-20:] // Keep only the 20 most recent elements.
-	}
-
-	update := bson.M{"$set": bson.M{"viewHistory": clicks}}
-	if _, err := collection.UpdateOne(context.TODO(), bson.M{"name": "benjamin"}, update); err != nil {
-		log.Fatal(err)
+	// Keep the 20 most recent clicks (FIFO), the customer is created on its
+	// first click
+	update := bson.M{"$push": bson.M{"viewHistory": bson.M{"$each": bson.A{click}, "$slice": -MAX_VIEW_HISTORY}}}
+	if _, err := collection.UpdateOne(ctx, bson.M{"name": user}, update, options.Update().SetUpsert(true)); err != nil {
+		dbFailed(w, r, "Error saving click", err)
+		return
 	}
 }
 
 // pipelineP M means marking promotion
-func pipelineM(query string, page int, config *PromotionConfig) []bson.D {
+func pipelineM(query string, page int, config *PromotionConfig, boosts FieldBoosts) []bson.D {
 	var searchStage bson.D
 	searchStage = bson.D{
 		{"$search", bson.D{
-			{"index", "item_search2"},
+			{"index", SEARCH_INDEX},
 			{"compound", bson.D{
-				{"should", bson.A{
-					bson.D{{"text", bson.D{{"query", query}, {"path", "name2"}, {"score", bson.D{{"boost", bson.D{{"value", 20}}}}}}}},
-					bson.D{{"text", bson.D{{"query", query}, {"path", "name"}, {"score", bson.D{{"boost", bson.D{{"value", 15}}}}}}}},
-				}},
+				{"should", textClauses(query, boosts)},
 				{"minimumShouldMatch", 1},
 			}},
 		}},
@@ -274,15 +504,16 @@ func pipelineM(query string, page int, config *PromotionConfig) []bson.D {
 			logrus.Fields{
 				"formed query": query,
 			},
-		).Info("the enhanced query is")
+		).Debug("the enhanced query is")
+		should := bson.A{}
+		for _, path := range boosts.Paths() {
+			should = append(should, bson.D{{"queryString", bson.D{{"query", query}, {"defaultPath", path}, {"score", bson.D{{"boost", bson.D{{"value", boosts[path]}}}}}}}})
+		}
 		searchStage = bson.D{
 			{"$search", bson.D{
-				{"index", "item_search2"},
+				{"index", SEARCH_INDEX},
 				{"compound", bson.D{
-					{"should", bson.A{
-						bson.D{{"queryString", bson.D{{"query", query}, {"defaultPath", "name2"}, {"score", bson.D{{"boost", bson.D{{"value", 20}}}}}}}},
-						bson.D{{"queryString", bson.D{{"query", query}, {"defaultPath", "name"}, {"score", bson.D{{"boost", bson.D{{"value", 15}}}}}}}},
-					}},
+					{"should", should},
 					{"minimumShouldMatch", 1},
 				}},
 			}},
@@ -290,19 +521,7 @@ func pipelineM(query string, page int, config *PromotionConfig) []bson.D {
 	}
 
 	limitStage := bson.D{{"$limit", 10}}
-	projectStage := bson.D{
-		{
-			Key: "$project", Value: bson.D{
-				{"_id", 0},
-				{"name", 1},
-				{"name2", 1},
-				{"price", 1},
-				{"imageUrl", 1},
-				{"imageUrl2", 1},
-				{"documentId", 1},
-			},
-		},
-	}
+	projectStage := bson.D{{"$project", itemProjection()}}
 	skipStage := bson.D{{"$skip", (page - 1) * 10}}
 	// Modify according to your needs
 	p := mongo.Pipeline{searchStage, limitStage, projectStage}
@@ -314,40 +533,58 @@ func pipelineM(query string, page int, config *PromotionConfig) []bson.D {
 			"query":   query,
 			"pipline": p,
 		},
-	).Info("generated pipline finished")
+	).Debug("generated pipline finished")
 	return p
 }
 
-// pipelineP P means personalized
-func pipelineP(query string, page int, views []bson.M) []bson.D {
-	searchStage := bson.D{
-		{"$search", bson.D{
-			{"index", "item_search2"},
-			{"compound", bson.D{
-				{"should", bson.A{
-					bson.D{{"text", bson.D{{"query", query}, {"path", "name2"}, {"score", bson.D{{"boost", bson.D{{"value", 20}}}}}}}},
-					bson.D{{"text", bson.D{{"query", query}, {"path", "name"}, {"score", bson.D{{"boost", bson.D{{"value", 15}}}}}}}},
-					bson.D{{"text", bson.D{{"query", query}, {"path", "discountTag"}}}},
-					bson.D{{"moreLikeThis", bson.D{{"like", views}}}},
-				}},
-				{"minimumShouldMatch", 1},
-			}},
+// organicClauses are the user input keywords clauses of the personalized search
+func organicClauses(query string, boosts FieldBoosts) bson.A {
+	return textClauses(query, boosts)
+}
+
+// personalizedClauses are the user's view history and profile tags clauses
+// of the personalized search
+func personalizedClauses(profile *PersonalizationProfile) bson.A {
+	should := bson.A{}
+	if profile == nil {
+		return should
+	}
+	for _, s := range profile.Signals {
+		should = append(should, bson.D{{"moreLikeThis", bson.D{{"like", s.Like}, {"score", bson.D{{"boost", bson.D{{"value", s.Boost}}}}}}}})
+	}
+	if len(profile.Tags) != 0 {
+		c := config.Personalization
+		should = append(should,
+			bson.D{{"text", bson.D{{"query", profile.Tags}, {"path", "productTag"}, {"score", bson.D{{"boost", bson.D{{"value", c.ProductTagBoost}}}}}}}},
+			bson.D{{"text", bson.D{{"query", profile.Tags}, {"path", "discountTag"}, {"score", bson.D{{"boost", bson.D{{"value", c.DiscountTagBoost}}}}}}}},
+		)
+	}
+	return should
+}
+
+// pipelineP P means personalized, every personalization signal becomes one
+// moreLikeThis clause with its own boost, and the user's profile tags boost
+// the items with matching productTag or discountTag
+func pipelineP(query string, page int, profile *PersonalizationProfile, opts SearchOptions) []bson.D {
+	should := append(organicClauses(query, opts.Boosts), personalizedClauses(profile)...)
+	search := bson.D{
+		{"index", SEARCH_INDEX},
+		{"compound", bson.D{
+			{"should", should},
+			{"minimumShouldMatch", 1},
 		}},
 	}
-	limitStage := bson.D{{"$limit", 10}}
-	projectStage := bson.D{
-		{
-			Key: "$project", Value: bson.D{
-				{"_id", 0},
-				{"name", 1},
-				{"name2", 1},
-				{"price", 1},
-				{"imageUrl", 1},
-				{"imageUrl2", 1},
-				{"documentId", 1},
-			},
-		},
+	projection := itemProjection()
+	if opts.Debug {
+		search = append(search, bson.E{"scoreDetails", true})
+		projection = append(projection,
+			bson.E{"score", bson.D{{"$meta", "searchScore"}}},
+			bson.E{"scoreDetails", bson.D{{"$meta", "searchScoreDetails"}}},
+		)
 	}
+	searchStage := bson.D{{"$search", search}}
+	limitStage := bson.D{{"$limit", 10}}
+	projectStage := bson.D{{Key: "$project", Value: projection}}
 	skipStage := bson.D{{"$skip", (page - 1) * 10}}
 	// Modify according to your needs
 	p := mongo.Pipeline{searchStage, limitStage, projectStage}
@@ -359,38 +596,22 @@ func pipelineP(query string, page int, views []bson.M) []bson.D {
 			"query":   query,
 			"pipline": p,
 		},
-	).Info("generated pipline finished")
+	).Debug("generated pipline finished")
 	return p
 }
 
-func pipeline(query string, page int) []bson.D {
+func pipeline(query string, page int, boosts FieldBoosts) []bson.D {
 	searchStage := bson.D{
 		{"$search", bson.D{
-			{"index", "item_search2"},
+			{"index", SEARCH_INDEX},
 			{"compound", bson.D{
-				{"should", bson.A{
-					bson.D{{"text", bson.D{{"query", query}, {"path", "name2"}, {"score", bson.D{{"boost", bson.D{{"value", 3}}}}}}}},
-					bson.D{{"text", bson.D{{"query", query}, {"path", "name"}}}},
-					bson.D{{"text", bson.D{{"query", query}, {"path", "discountTag"}}}},
-				}},
+				{"should", textClauses(query, boosts)},
 				{"minimumShouldMatch", 1},
 			}},
 		}},
 	}
 	limitStage := bson.D{{"$limit", 10}}
-	projectStage := bson.D{
-		{
-			Key: "$project", Value: bson.D{
-				{"_id", 0},
-				{"name", 1},
-				{"name2", 1},
-				{"price", 1},
-				{"imageUrl", 1},
-				{"imageUrl2", 1},
-				{"documentId", 1},
-			},
-		},
-	}
+	projectStage := bson.D{{"$project", itemProjection()}}
 	skipStage := bson.D{{"$skip", (page - 1) * 10}}
 	// Modify according to your needs
 	p := mongo.Pipeline{searchStage, limitStage, projectStage}
@@ -404,349 +625,310 @@ func pipeline(query string, page int) []bson.D {
 			"query":   query,
 			"pipline": p,
 		},
-	).Info("generated pipline finished")
+	).Debug("generated pipline finished")
 	return p
 }
 
 func personalizedSearchHandler(w http.ResponseWriter, r *http.Request) {
-	pageNum := r.URL.Query().Get("page")
-	page, err := strconv.Atoi(pageNum)
-	if err != nil {
-		page = 0
+	v := &validator{}
+	page := v.page(r)
+	query := v.query(r)
+	user := v.user(r)
+
+	opts := defaultSearchOptions(MODE_PERSONALIZED)
+	opts.Debug = v.boolParam(r, "debug")
+	if strategy := r.URL.Query().Get("blend"); strategy != "" {
+		v.oneOf("blend", strategy, BLEND_COMPOUND, BLEND_SCORE, BLEND_RRF, BLEND_INTERLEAVE)
+		opts.Blend = strategy
+	}
+	if v.reject(w) {
+		return
 	}
-	query := r.URL.Query().Get("query")
-
-	searchItems := personalizedSearch(query, page)
-
-	// Convert the data to JSON
-	jsonData, err := json.Marshal(searchItems)
-	if err != nil {
-		http.Error(w, "Error converting data", http.StatusInternalServerError)
+	if !authorizeUser(w, r, user) {
+		return
+	}
+	// The debug scores show how the ranking is tuned
+	if opts.Debug && !authorize(w, r, ROLE_ANALYST, ROLE_MERCHANDISER) {
 		return
 	}
-	go queryReport(query)
 
-	// Set the Content-Type and write the JSON response
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(jsonData)
+	// The searches choosing their strategy or debugging aren't experiment
+	// traffic
+	experiment := !opts.Debug && !r.URL.Query().Has("blend")
+	serveSearch(w, r, user, query, page, MODE_PERSONALIZED, opts, experiment)
 }
 
 func marketingSearchHandler(w http.ResponseWriter, r *http.Request) {
-	pageNum := r.URL.Query().Get("page")
-	page, err := strconv.Atoi(pageNum)
-	if err != nil {
-		page = 0
+	v := &validator{}
+	page := v.page(r)
+	query := v.query(r)
+	user := v.user(r)
+	if v.reject(w) {
+		return
 	}
-	query := r.URL.Query().Get("query")
-
-	searchItems := marktingSearch(query, page)
-
-	// Convert the data to JSON
-	jsonData, err := json.Marshal(searchItems)
-	if err != nil {
-		http.Error(w, "Error converting data", http.StatusInternalServerError)
+	if !authorizeUser(w, r, user) {
 		return
 	}
-	go queryReport(query)
 
-	// Set the Content-Type and write the JSON response
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(jsonData)
+	serveSearch(w, r, user, query, page, MODE_MARKETING, defaultSearchOptions(MODE_MARKETING), true)
 }
 
-func queryReport(query string) {
-	client, err := GetMongoClient()
-	if err != nil {
-		log.Fatal(err)
+// serveSearch answers the search of the mode and records it. When the mode
+// is in the running experiment, the user's variant serves it
+func serveSearch(w http.ResponseWriter, r *http.Request, user, query string, page int, mode string, opts SearchOptions, experiment bool) {
+	var variant *VariantConfig
+	if experiment && experimentIncludes(mode) {
+		variant, mode, opts = userVariant(r.Context(), user, mode, opts)
 	}
-	collection := client.Database(DB).Collection(SEARCH_REPORT_COLLECTION)
-
-	var searchReport QueryReport
-	filter := bson.M{"name": "benjamin", "query": query}
-	if err = collection.FindOne(context.TODO(), filter).Decode(&searchReport); err != nil && err != mongo.ErrNoDocuments {
-		log.WithFields(
-			logrus.Fields{
-				"query": query,
-				"err":   err,
-			},
-		).Error("get user search query from mongoDB failed")
-		return
+	searchItems, err := modeSearch(r.Context(), mode, user, query, page, opts)
+	if variant != nil {
+		searchItems.Variant = variant.Name
 	}
-
-	log.WithFields(
-		logrus.Fields{
-			"query":  query,
-			"result": searchReport,
-			"err":    err,
-		}).Info("search one query result ")
-	if err == mongo.ErrNoDocuments {
-		searchReport.Count = 1
-		searchReport.Query = query
-		searchReport.SearchTime = time.Now()
-		searchReport.User = "benjamin"
-	} else {
-		searchReport.Count++
+	if writeSearchRsp(w, r, searchItems, err) {
+		queryReport(r.Context(), user, query)
+		recordSearch(user, variant, mode, query, len(searchItems.SearchResults))
 	}
+}
 
-	update := bson.M{
-		"$set": searchReport,
+// queryReport records the user's query in the search history. It's written
+// by the history writer, so the search doesn't wait for MongoDB
+func queryReport(ctx context.Context, user, query string) {
+	if query == "" {
+		return
 	}
-	// Set the Upsert option to true
-	opts := options.Update().SetUpsert(true)
-
-	if _, err := collection.UpdateOne(context.TODO(), filter, update, opts); err != nil {
-		log.Error(err)
+	// The sample of the served queries is what replay -source log reads
+	if sampled(SEARCH_QUERY_LOG) {
+		log.WithContext(ctx).WithFields(
+			logrus.Fields{
+				"query": query,
+			}).Info(SEARCH_QUERY_LOG)
 	}
+	recordHistory(user, query)
 }
 
 // searchHandler accept the search request, search the match items
 // and provided moreLikeThis recommendation.
 func searchHandler(w http.ResponseWriter, r *http.Request) {
-	pageNum := r.URL.Query().Get("page")
-	// If a query exists, filter items
-	page, err := strconv.Atoi(pageNum)
-	if err != nil {
-		page = 0
+	v := &validator{}
+	page := v.page(r)
+	query := v.query(r)
+	user := v.user(r)
+	if v.reject(w) {
+		return
 	}
-	query := r.URL.Query().Get("query")
-
-	searchItems := search(query, page)
-
-	// Convert the data to JSON
-	jsonData, err := json.Marshal(searchItems)
-	if err != nil {
-		http.Error(w, "Error converting data", http.StatusInternalServerError)
+	if !authorizeUser(w, r, user) {
 		return
 	}
 
-	go queryReport(query)
-	// Set the Content-Type and write the JSON response
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(jsonData)
+	serveSearch(w, r, user, query, page, MODE_SEARCH, defaultSearchOptions(MODE_SEARCH), true)
 }
 
 // personalizedSearch will merge the user-activity-based recommendation with
-// user input keywords search result as response
-func personalizedSearch(query string, page int) SearchRsp {
+// user input keywords search result as response. With debug the results carry
+// the Atlas score details and the matched profile tags. When the profile or
+// the personalized retrieval fails, it returns the organic results with a
+// DegradedError
+func personalizedSearch(ctx context.Context, user, query string, page int, opts SearchOptions) (SearchRsp, error) {
 	var rsp SearchRsp
-	client, err := GetMongoClient()
+	client, err := GetMongoClient(ctx)
 	if err != nil {
-		log.Fatal(err)
+		return rsp, err
 	}
 	collection := client.Database(DB).Collection(COLLECTION)
-	views := getRecentViewItems()
-	p := pipelineP(query, page, views)
-
-	cursor, err := collection.Aggregate(context.TODO(), p)
-	if err != nil {
-		log.Fatal(err)
+	loadProfile := func(ctx context.Context) (*PersonalizationProfile, error) {
+		return loadPersonalizationProfile(ctx, user)
 	}
+
 	var results []bson.M
-	if err = cursor.All(context.Background(), &results); err != nil {
-		log.Fatal(err)
+	var profile *PersonalizationProfile
+	if opts.Blend == BLEND_COMPOUND {
+		// The compound search needs the profile first
+		profile, err = loadProfile(ctx)
+		if err != nil {
+			err = &DegradedError{Retrievals: []string{"profile"}, Err: err}
+		}
+		p := pipelineP(query, page, profile, opts)
+
+		searchCtx, cancel := withDeadline(ctx, config.Timeouts.SearchMs)
+		defer cancel()
+		var searchErr error
+		if results, searchErr = aggregateItems(searchCtx, "search.compound", collection, p); searchErr != nil {
+			return rsp, searchErr
+		}
+	} else {
+		results, profile, err = blendSearch(ctx, &mongoSearcher{collection: collection}, query, page, loadProfile, opts)
+		if err != nil && !isDegraded(err) && !isTimeout(err) {
+			return rsp, err
+		}
 	}
-	rsp.SearchResults = results
-	return rsp
+	if opts.Debug && profile != nil {
+		annotateTagMatches(results, profile.Tags)
+	}
+	rsp.SearchResults = toResults(results)
+	return rsp, err
 }
 
 // marktingSearch will merge the commany operator configured promotion items with
 // user input keywords search result as response
-func marktingSearch(query string, page int) SearchRsp {
+func marktingSearch(ctx context.Context, query string, page int, opts SearchOptions) (SearchRsp, error) {
 	var rsp SearchRsp
-	client, err := GetMongoClient()
+	client, err := GetMongoClient(ctx)
 	if err != nil {
-		log.Fatal(err)
+		return rsp, err
 	}
 	collection := client.Database(DB).Collection(COLLECTION)
-	config := getMarketingConfig()
-	p := pipelineM(query, page, config)
+	p := pipelineM(query, page, activePromotion(), opts.Boosts)
 
-	cursor, err := collection.Aggregate(context.TODO(), p)
+	ctx, cancel := withDeadline(ctx, config.Timeouts.SearchMs)
+	defer cancel()
+	results, err := aggregateItems(ctx, "search.marketing", collection, p)
 	if err != nil {
-		log.Fatal(err)
-	}
-	var results []bson.M
-	if err = cursor.All(context.Background(), &results); err != nil {
-		log.Fatal(err)
+		return rsp, err
 	}
-	rsp.SearchResults = results
-	return rsp
+	rsp.SearchResults = toResults(results)
+	return rsp, nil
 }
 
-// search ask Atlas search for the text search
+// search ask Atlas search for the text search, and for the items like the
+// user's recently viewed one concurrently. When only the moreLikeThis search fails,
+// it returns the search results with a DegradedError, and when the text search
+// times out, the recommendation with the timeout. The text results come
+// from the result cache, the recommendation never does
 // pipeline: { "$search": { "index": "item_search2", "compound": { "should": [ { "text": { "query": "白", "path": "name2", "score": { "boost": { "value": 3 } } } }, { "text": { "query": "白", "path": "name" } }, { "text": { "query": "白", "path": "discountTag" } } ], "minimumShouldMatch": 1 } } }
-func search(query string, page int) SearchRsp {
+func search(ctx context.Context, user, query string, page int, opts SearchOptions) (SearchRsp, error) {
 	var rsp SearchRsp
-	client, err := GetMongoClient()
-	if err != nil {
-		log.Fatal(err)
+	err := fanOut(ctx, config.Timeouts.SearchMs,
+		Retrieval{Name: "text search", Required: true, Run: func(ctx context.Context) error {
+			// The text results are the same for every user, they are cached
+			// and shared without the user's recommendation
+			text, err := cachedSearch(ctx, MODE_SEARCH, user, query, page, opts, func(ctx context.Context) (SearchRsp, error) {
+				return textSearch(ctx, query, page, opts)
+			})
+			rsp.SearchResults = text.SearchResults
+			return err
+		}},
+		Retrieval{Name: "moreLikeThis", Run: func(ctx context.Context) (err error) {
+			rsp.MoreLikeThisResults, err = moreLikeThis(ctx, user)
+			return err
+		}},
+	)
+	if err != nil && !isDegraded(err) && !isTimeout(err) {
+		return SearchRsp{}, err
 	}
-	collection := client.Database(DB).Collection(COLLECTION)
-
-	p := pipeline(query, page)
+	// On a timeout of the text search, the recommendation retrieved in time
+	// is returned with the error
+	return rsp, err
+}
 
-	cursor, err := collection.Aggregate(context.TODO(), p)
+// textSearch gets the /search results of the query, without the user's
+// recommendation
+func textSearch(ctx context.Context, query string, page int, opts SearchOptions) (SearchRsp, error) {
+	var rsp SearchRsp
+	client, err := GetMongoClient(ctx)
 	if err != nil {
-		log.Fatal(err)
-	}
-	var results []bson.M
-	if err = cursor.All(context.Background(), &results); err != nil {
-		log.Fatal(err)
+		return rsp, err
 	}
-	rsp.SearchResults = results
-	rsp.MoreLikeThisResults = moreLikeThis()
-	return rsp
+	ctx, cancel := withDeadline(ctx, config.Timeouts.SearchMs)
+	defer cancel()
+	collection := client.Database(DB).Collection(COLLECTION)
+	results, err := aggregateItems(ctx, "search.text", collection, pipeline(query, page, opts.Boosts))
+	rsp.SearchResults = toResults(results)
+	return rsp, err
+}
+
+// modeSearch runs the search of the mode through the result cache
+func modeSearch(ctx context.Context, mode, user, query string, page int, opts SearchOptions) (SearchRsp, error) {
+	switch mode {
+	case MODE_PERSONALIZED:
+		return cachedSearch(ctx, mode, user, query, page, opts, func(ctx context.Context) (SearchRsp, error) {
+			return personalizedSearch(ctx, user, query, page, opts)
+		})
+	case MODE_MARKETING:
+		return cachedSearch(ctx, mode, user, query, page, opts, func(ctx context.Context) (SearchRsp, error) {
+			return marktingSearch(ctx, query, page, opts)
+		})
+	}
+	// search caches its text results itself
+	return search(ctx, user, query, page, opts)
 }
 
 func moreLikePipe(like bson.M) []bson.D {
 	searchStage := bson.D{
 		{"$search", bson.D{
-			{"index", "item_search2"},
+			{"index", SEARCH_INDEX},
 			{"moreLikeThis", bson.D{
 				{"like", like},
 			}},
 		}},
 	}
 	limitStage := bson.D{{"$limit", 20}}
-	projectStage := bson.D{
-		{
-			Key: "$project", Value: bson.D{
-				{"_id", 0},
-				{"name", 1},
-				{"name2", 1},
-				{"price", 1},
-				{"imageUrl", 1},
-				{"imageUrl2", 1},
-				{"documentId", 1},
-			},
-		},
-	}
+	projectStage := bson.D{{"$project", itemProjection()}}
 	// Modify according to your needs
 	p := mongo.Pipeline{searchStage, limitStage, projectStage}
 
 	return p
 }
 
-// getRecentViewItems gets the user's view history, and get latest 5 items
-// as response
-func getRecentViewItems() []bson.M {
-	client, err := GetMongoClient()
+// getRecentViewItem gets the item the user viewed last, nil when there is
+// none
+func getRecentViewItem(ctx context.Context, user string) (like bson.M, err error) {
+	ctx, span := startSpan(ctx, "search.recentViewItem")
+	defer func() { endSpan(span, err) }()
+	client, err := GetMongoClient(ctx)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	collection := client.Database(DB).Collection(CUSTOMER_COLLECTION)
 
 	var doc bson.M
-	if err := collection.FindOne(context.TODO(), bson.M{"name": "benjamin"}).Decode(&doc); err != nil {
-		log.Fatal(err)
-	}
-	views := doc["viewHistory"].(bson.A)
-	var IDs []string
-	for i := len(views) - 1; i > 0; i-- {
-		IDs = append(IDs, views[i].(bson.M)["documentId"].(string))
-		if len(IDs) == 5 {
-			break
-		}
-	}
-
-	// Create a projection
-	projection := bson.M{
-		"name":  1,
-		"name2": 1,
-	}
-
-	// Set the projection in the find options
-	findOptions := options.Find().SetProjection(projection)
-	icollection := client.Database(DB).Collection(COLLECTION)
-	cursor, err := icollection.Find(context.TODO(), bson.M{"documentId": bson.M{"$in": IDs}}, findOptions)
-
-	if err != nil {
-		log.Fatal(err)
-	}
-	var results []bson.M
-	if err = cursor.All(context.Background(), &results); err != nil {
-		log.Fatal(err)
-	}
-	return results
-}
-
-// getMarketingConfig gets the active promotion configuration from DB
-func getMarketingConfig() *PromotionConfig {
-	client, err := GetMongoClient()
-	if err != nil {
-		log.Fatal(err)
-	}
-	collection := client.Database(DB).Collection(MARKETING_CONFIG_COLLECTION)
-	filter := bson.M{
-		"status": "active",
-		"startDate": bson.M{
-			"$lte": time.Now(),
-		},
-		"endDate": bson.M{
-			"$gte": time.Now(),
-		},
-	}
-
-	// Fetch the document
-	var p PromotionConfig
-	err = collection.FindOne(context.TODO(), filter).Decode(&p)
-	if err != nil {
+	if err := collection.FindOne(ctx, bson.M{"name": user}).Decode(&doc); err != nil {
 		if err == mongo.ErrNoDocuments {
-			log.WithFields(
-				logrus.Fields{
-					"filter": filter,
-				}).Info("No active promotion found")
-			return nil
-		} else {
-			log.Fatal(err)
+			return nil, nil
 		}
+		return nil, err
 	}
-	return &p
-}
-
-func getRecentViewItem() bson.M {
-	client, err := GetMongoClient()
-	if err != nil {
-		log.Fatal(err)
+	views, _ := doc["viewHistory"].(bson.A)
+	if len(views) == 0 {
+		return nil, nil
 	}
-	collection := client.Database(DB).Collection(CUSTOMER_COLLECTION)
-
-	var doc bson.M
-	if err := collection.FindOne(context.TODO(), bson.M{"name": "benjamin"}).Decode(&doc); err != nil {
-		log.Fatal(err)
+	v, _ := views[len(views)-1].(bson.M)
+	if sampled("recent view history") {
+		log.WithContext(ctx).WithFields(
+			logrus.Fields{
+				"documentId": v["documentId"],
+			}).Debug("get user recent view history")
 	}
-	views := doc["viewHistory"].(bson.A)
-	v := views[len(views)-1].(bson.M)
-	log.WithFields(
-		logrus.Fields{
-			"recentViewItems": v,
-		}).Info("get user recent view history")
 
 	icollection := client.Database(DB).Collection(COLLECTION)
-	var like bson.M
-	if err := icollection.FindOne(context.TODO(), bson.M{"documentId": v["documentId"]}).Decode(&like); err != nil {
-		log.Fatal(err)
+	if err := icollection.FindOne(ctx, bson.M{"documentId": v["documentId"]}).Decode(&like); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, err
 	}
-	return like
+	return like, nil
 }
 
-func moreLikeThis() Results {
-	client, err := GetMongoClient()
+func moreLikeThis(ctx context.Context, user string) (_ Results, err error) {
+	ctx, span := startSpan(ctx, "search.moreLikeThis")
+	defer func() { endSpan(span, err) }()
+	client, err := GetMongoClient(ctx)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
+	ctx, cancel := withDeadline(ctx, config.Timeouts.MoreLikeThisMs)
+	defer cancel()
 
 	collection := client.Database(DB).Collection(COLLECTION)
-	like := getRecentViewItem()
+	like, err := getRecentViewItem(ctx, user)
+	if err != nil || like == nil {
+		return Results{}, err
+	}
 	p := moreLikePipe(like)
 
-	cursor, err := collection.Aggregate(context.TODO(), p)
+	results, err := aggregateItems(ctx, "search.moreLikeThis.aggregate", collection, p)
 	if err != nil {
-		log.Fatal(err)
-	}
-	var results []bson.M
-	if err = cursor.All(context.Background(), &results); err != nil {
-		log.Fatal(err)
+		return Results{}, err
 	}
-	return results
+	return toResults(results), nil
 }
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Blend strategies of the personalized search
+const (
+	BLEND_COMPOUND   = "compound"   // one $search with the organic and personalized clauses mixed
+	BLEND_SCORE      = "score"      // normalized score fusion
+	BLEND_RRF        = "rrf"        // reciprocal rank fusion
+	BLEND_INTERLEAVE = "interleave" // personalized hits on fixed slots of every page
+)
+
+// Sources of the blended hits
+const (
+	SOURCE_ORGANIC      = "organic"
+	SOURCE_PERSONALIZED = "personalized"
+	SOURCE_BOTH         = "both"
+)
+
+const PAGE_SIZE = 10
+
+// blendHit is one retrieved item with its rank in the organic and the
+// personalized result lists, rank 0 means it's not in the list
+type blendHit struct {
+	item          bson.M
+	organicScore  float64
+	organicRank   int
+	personalScore float64
+	personalRank  int
+	blendScore    float64
+}
+
+func (h *blendHit) source() string {
+	switch {
+	case h.organicRank > 0 && h.personalRank > 0:
+		return SOURCE_BOTH
+	case h.personalRank > 0:
+		return SOURCE_PERSONALIZED
+	default:
+		return SOURCE_ORGANIC
+	}
+}
+
+// retrievalPipeline searches the should clauses and keeps the top limit
+// items with their search score
+func retrievalPipeline(should bson.A, limit int, debug bool) mongo.Pipeline {
+	search := bson.D{
+		{"index", SEARCH_INDEX},
+		{"compound", bson.D{
+			{"should", should},
+			{"minimumShouldMatch", 1},
+		}},
+	}
+	projection := append(itemProjection(), bson.E{"score", bson.D{{"$meta", "searchScore"}}})
+	if debug {
+		search = append(search, bson.E{"scoreDetails", true})
+		projection = append(projection,
+			bson.E{"scoreDetails", bson.D{{"$meta", "searchScoreDetails"}}},
+		)
+	}
+	return mongo.Pipeline{
+		{{"$search", search}},
+		{{"$limit", limit}},
+		{{"$project", projection}},
+	}
+}
+
+// retrieve runs one retrieval, an empty clause list retrieves nothing
+func retrieve(ctx context.Context, searcher Searcher, should bson.A, limit int, debug bool) ([]bson.M, error) {
+	if len(should) == 0 {
+		return nil, nil
+	}
+	return searcher.Aggregate(ctx, retrievalPipeline(should, limit, debug))
+}
+
+// profileLoader loads the personalization profile as a part of the
+// personalized retrieval
+type profileLoader func(context.Context) (*PersonalizationProfile, error)
+
+// staticProfile is the loader of an already loaded profile
+func staticProfile(profile *PersonalizationProfile) profileLoader {
+	return func(context.Context) (*PersonalizationProfile, error) {
+		return profile, nil
+	}
+}
+
+// blendSearch runs the organic retrieval, and the profile loading followed
+// by the personalized retrieval, concurrently. It merges them with the
+// strategy and returns the page with every hit labeled with its source, and
+// the loaded profile. When only the personalized side fails, it returns the
+// page of the organic results with a DegradedError, and when the organic
+// retrieval times out, the page of the personalized results retrieved in
+// time with the timeout
+func blendSearch(ctx context.Context, searcher Searcher, query string, page int, loadProfile profileLoader, opts SearchOptions) ([]bson.M, *PersonalizationProfile, error) {
+	if page < 1 {
+		page = 1
+	}
+	limit := page * PAGE_SIZE
+	if config.Blend.CandidateSize > limit {
+		limit = config.Blend.CandidateSize
+	}
+
+	var organic, personalized []bson.M
+	var profile *PersonalizationProfile
+	err := fanOut(ctx, config.Timeouts.SearchMs,
+		Retrieval{Name: SOURCE_ORGANIC, Required: true, Run: func(ctx context.Context) (err error) {
+			if query == "" {
+				return nil
+			}
+			ctx, span := startSpan(ctx, "blend.retrieve", attribute.String("source", SOURCE_ORGANIC))
+			defer func() { endSpan(span, err) }()
+			organic, err = retrieve(ctx, searcher, organicClauses(query, opts.Boosts), limit, opts.Debug)
+			return err
+		}},
+		Retrieval{Name: SOURCE_PERSONALIZED, Run: func(ctx context.Context) (err error) {
+			if profile, err = loadProfile(ctx); err != nil {
+				return err
+			}
+			ctx, span := startSpan(ctx, "blend.retrieve", attribute.String("source", SOURCE_PERSONALIZED))
+			defer func() { endSpan(span, err) }()
+			personalized, err = retrieve(ctx, searcher, personalizedClauses(profile), limit, opts.Debug)
+			return err
+		}},
+	)
+	if err != nil && !isDegraded(err) && !isTimeout(err) {
+		return nil, nil, err
+	}
+
+	merged := blend(organic, personalized, opts.Blend, config.Blend)
+	if sampled("blended personalized search") {
+		log.WithContext(ctx).WithFields(
+			logrus.Fields{
+				"query":        query,
+				"strategy":     opts.Blend,
+				"organic":      len(organic),
+				"personalized": len(personalized),
+				"merged":       len(merged),
+			}).Info("blended personalized search")
+	}
+
+	start := (page - 1) * PAGE_SIZE
+	if start >= len(merged) {
+		return []bson.M{}, profile, err
+	}
+	end := start + PAGE_SIZE
+	if end > len(merged) {
+		end = len(merged)
+	}
+	return merged[start:end], profile, err
+}
+
+// blend merges the two ranked lists with the strategy, the items in both
+// lists are deduplicated by documentId
+func blend(organic, personalized []bson.M, strategy string, c BlendConfig) []bson.M {
+	hits := map[string]*blendHit{}
+	var order []*blendHit
+	add := func(list []bson.M, personal bool) {
+		for i, item := range list {
+			id, _ := item["documentId"].(string)
+			h, ok := hits[id]
+			if !ok {
+				h = &blendHit{item: item}
+				hits[id] = h
+				order = append(order, h)
+			}
+			score, _ := item["score"].(float64)
+			if personal {
+				h.personalRank, h.personalScore = i+1, score
+			} else {
+				h.organicRank, h.organicScore = i+1, score
+			}
+		}
+	}
+	add(organic, false)
+	add(personalized, true)
+
+	var ranked []*blendHit
+	switch strategy {
+	case BLEND_INTERLEAVE:
+		ranked = interleave(organic, personalized, hits, c.PersonalizedSlots)
+	case BLEND_SCORE:
+		organicMax, personalMax := maxScore(organic), maxScore(personalized)
+		for _, h := range order {
+			if organicMax > 0 {
+				h.blendScore += c.OrganicWeight * h.organicScore / organicMax
+			}
+			if personalMax > 0 {
+				h.blendScore += c.PersonalizedWeight * h.personalScore / personalMax
+			}
+		}
+		ranked = sortHits(order)
+	default:
+		for _, h := range order {
+			if h.organicRank > 0 {
+				h.blendScore += c.OrganicWeight / (c.RRFK + float64(h.organicRank))
+			}
+			if h.personalRank > 0 {
+				h.blendScore += c.PersonalizedWeight / (c.RRFK + float64(h.personalRank))
+			}
+		}
+		ranked = sortHits(order)
+	}
+
+	results := make([]bson.M, 0, len(ranked))
+	for _, h := range ranked {
+		h.item["source"] = h.source()
+		if strategy != BLEND_INTERLEAVE {
+			h.item["blendScore"] = h.blendScore
+		}
+		results = append(results, h.item)
+	}
+	return results
+}
+
+// interleave fills the configured slots of every page with the personalized
+// hits and the others with the organic hits, either list fills the other's
+// slots when it runs out
+func interleave(organic, personalized []bson.M, hits map[string]*blendHit, slots []int) []*blendHit {
+	isSlot := map[int]bool{}
+	for _, s := range slots {
+		isSlot[s] = true
+	}
+	used := map[*blendHit]bool{}
+	next := func(list []bson.M, i *int) *blendHit {
+		for *i < len(list) {
+			id, _ := list[*i]["documentId"].(string)
+			*i++
+			if h := hits[id]; !used[h] {
+				return h
+			}
+		}
+		return nil
+	}
+
+	var ranked []*blendHit
+	o, p := 0, 0
+	for {
+		var h *blendHit
+		if isSlot[len(ranked)%PAGE_SIZE+1] {
+			if h = next(personalized, &p); h == nil {
+				h = next(organic, &o)
+			}
+		} else {
+			if h = next(organic, &o); h == nil {
+				h = next(personalized, &p)
+			}
+		}
+		if h == nil {
+			return ranked
+		}
+		used[h] = true
+		ranked = append(ranked, h)
+	}
+}
+
+func sortHits(hits []*blendHit) []*blendHit {
+	sorted := append([]*blendHit(nil), hits...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].blendScore > sorted[j].blendScore
+	})
+	return sorted
+}
+
+func maxScore(list []bson.M) float64 {
+	max := 0.0
+	for _, item := range list {
+		if score, _ := item["score"].(float64); score > max {
+			max = score
+		}
+	}
+	return max
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func blendItems(scores ...interface{}) []bson.M {
+	var items []bson.M
+	for i := 0; i < len(scores); i += 2 {
+		items = append(items, bson.M{"documentId": scores[i], "score": scores[i+1]})
+	}
+	return items
+}
+
+func TestBlend(t *testing.T) {
+	c := BlendConfig{
+		OrganicWeight:      1,
+		PersonalizedWeight: 0.5,
+		RRFK:               60,
+		PersonalizedSlots:  []int{3, 6, 9},
+	}
+	tests := []struct {
+		name         string
+		strategy     string
+		organic      []bson.M
+		personalized []bson.M
+		wantIDs      []string
+		wantSources  []string
+	}{
+		{
+			name:         "rrf ranks the items of both lists first",
+			strategy:     BLEND_RRF,
+			organic:      blendItems("a", 10.0, "b", 8.0, "c", 5.0),
+			personalized: blendItems("c", 3.0, "d", 2.0),
+			wantIDs:      []string{"c", "a", "b", "d"},
+			wantSources:  []string{SOURCE_BOTH, SOURCE_ORGANIC, SOURCE_ORGANIC, SOURCE_PERSONALIZED},
+		},
+		{
+			name:         "score fusion keeps the organic order of ties",
+			strategy:     BLEND_SCORE,
+			organic:      blendItems("a", 10.0, "b", 8.0, "c", 5.0),
+			personalized: blendItems("c", 3.0, "d", 2.0),
+			wantIDs:      []string{"a", "c", "b", "d"},
+			wantSources:  []string{SOURCE_ORGANIC, SOURCE_BOTH, SOURCE_ORGANIC, SOURCE_PERSONALIZED},
+		},
+		{
+			name:         "interleave fills the slots and skips the used items",
+			strategy:     BLEND_INTERLEAVE,
+			organic:      blendItems("a", 10.0, "b", 8.0, "c", 5.0, "e", 1.0),
+			personalized: blendItems("c", 3.0, "d", 2.0),
+			wantIDs:      []string{"a", "b", "c", "e", "d"},
+			wantSources:  []string{SOURCE_ORGANIC, SOURCE_ORGANIC, SOURCE_BOTH, SOURCE_ORGANIC, SOURCE_PERSONALIZED},
+		},
+		{
+			name:         "interleave fills the organic slots with personalized items when organic runs out",
+			strategy:     BLEND_INTERLEAVE,
+			organic:      blendItems("a", 10.0),
+			personalized: blendItems("p", 3.0, "q", 2.0, "r", 1.0),
+			wantIDs:      []string{"a", "p", "q", "r"},
+			wantSources:  []string{SOURCE_ORGANIC, SOURCE_PERSONALIZED, SOURCE_PERSONALIZED, SOURCE_PERSONALIZED},
+		},
+		{
+			name:         "only personalized results",
+			strategy:     BLEND_RRF,
+			personalized: blendItems("p", 3.0, "q", 2.0),
+			wantIDs:      []string{"p", "q"},
+			wantSources:  []string{SOURCE_PERSONALIZED, SOURCE_PERSONALIZED},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results := blend(tt.organic, tt.personalized, tt.strategy, c)
+			if len(results) != len(tt.wantIDs) {
+				t.Fatalf("got %d results %v, want %v", len(results), documentIds(results), tt.wantIDs)
+			}
+			for i, r := range results {
+				if r["documentId"] != tt.wantIDs[i] || r["source"] != tt.wantSources[i] {
+					t.Errorf("result %d is %v from %v, want %s from %s", i, r["documentId"], r["source"], tt.wantIDs[i], tt.wantSources[i])
+				}
+				if _, ok := r["blendScore"]; ok == (tt.strategy == BLEND_INTERLEAVE) {
+					t.Errorf("result %d blendScore present is %v with %s", i, ok, tt.strategy)
+				}
+			}
+		})
+	}
+}
+
+func TestBlendRRFScores(t *testing.T) {
+	c := BlendConfig{OrganicWeight: 1, PersonalizedWeight: 0.5, RRFK: 60}
+	results := blend(blendItems("a", 10.0, "b", 8.0), blendItems("b", 3.0), BLEND_RRF, c)
+	want := map[string]float64{
+		"a": 1.0 / 61,
+		"b": 1.0/62 + 0.5/61,
+	}
+	for _, r := range results {
+		id := r["documentId"].(string)
+		if got := r["blendScore"].(float64); got != want[id] {
+			t.Errorf("%s blendScore is %v, want %v", id, got, want[id])
+		}
+	}
+}
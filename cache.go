@@ -0,0 +1,220 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/sync/singleflight"
+)
+
+// CacheKey identifies one cached search response. User is only set for the
+// personalized searches, Options are the search options changing the results
+type CacheKey struct {
+	Mode    string
+	Query   string
+	Page    int
+	User    string
+	Options string
+}
+
+func (k CacheKey) String() string {
+	return fmt.Sprintf("%s|%s|%d|%s|%s", k.Mode, k.Query, k.Page, k.User, k.Options)
+}
+
+// CacheStats are the result cache metrics of /cache/stats
+type CacheStats struct {
+	Hits      uint64  `json:"hits"`
+	Misses    uint64  `json:"misses"`
+	Shared    uint64  `json:"shared"`
+	Evictions uint64  `json:"evictions"`
+	Entries   int     `json:"entries"`
+	HitRate   float64 `json:"hitRate"`
+}
+
+type cacheEntry struct {
+	key     string
+	rsp     SearchRsp
+	expires time.Time
+}
+
+// resultCache is an LRU cache of the search responses with a TTL. The
+// concurrent misses of the same key share one search
+type resultCache struct {
+	mu      sync.Mutex
+	entries *list.List
+	index   map[string]*list.Element
+	group   singleflight.Group
+	// generation is bumped by every purge, so a search started before the
+	// purge doesn't cache its stale response
+	generation uint64
+
+	hits      uint64
+	misses    uint64
+	shared    uint64
+	evictions uint64
+}
+
+var searchCache = &resultCache{entries: list.New(), index: map[string]*list.Element{}}
+
+func init() {
+	// Any catalog change can change any cached result
+	onCatalogChange(func(e ChangeEvent) {
+		searchCache.purge()
+	})
+}
+
+// normalizeQuery lower cases the query and collapses the white space, the
+// search analyzers don't tell these variants apart
+func normalizeQuery(query string) string {
+	return strings.Join(strings.Fields(strings.ToLower(query)), " ")
+}
+
+// searchCacheKey gets the cache key of the search, and false when the search
+// isn't cached: debug searches, and personalized ones unless they are
+// configured to be cached per user
+func searchCacheKey(mode, user, query string, page int, opts SearchOptions) (CacheKey, bool) {
+	if opts.Debug || config.Cache.Size <= 0 {
+		return CacheKey{}, false
+	}
+	key := CacheKey{Mode: mode, Query: normalizeQuery(query), Page: page}
+	switch mode {
+	case MODE_PERSONALIZED:
+		if !config.Cache.PerUser {
+			return CacheKey{}, false
+		}
+		key.User = user
+	case MODE_MARKETING:
+		// The results change with the active promotion
+		if p := activePromotion(); p != nil {
+			key.Options = "promotion=" + p.ID.Hex() + ";"
+		}
+	}
+	key.Options += "blend=" + opts.Blend
+	for _, path := range opts.Boosts.Paths() {
+		key.Options += fmt.Sprintf(";%s=%g", path, opts.Boosts[path])
+	}
+	return key, true
+}
+
+// cachedSearch gets the cached response of the search, or runs it once for
+// all the concurrent requests of the same key and caches the response. The
+// shared search doesn't stop when one of the waiting requests is gone, it's
+// bounded by the search deadlines. Failed and partial responses aren't cached
+func cachedSearch(ctx context.Context, mode, user, query string, page int, opts SearchOptions, fn func(context.Context) (SearchRsp, error)) (SearchRsp, error) {
+	key, ok := searchCacheKey(mode, user, query, page, opts)
+	if !ok {
+		return fn(ctx)
+	}
+	k := key.String()
+	_, span := startSpan(ctx, "cache.lookup")
+	rsp, hit := searchCache.get(k)
+	span.SetAttributes(attribute.Bool("cache.hit", hit))
+	span.End()
+	if hit {
+		atomic.AddUint64(&searchCache.hits, 1)
+		cacheRequests.WithLabelValues("hit").Inc()
+		return rsp, nil
+	}
+	atomic.AddUint64(&searchCache.misses, 1)
+	cacheRequests.WithLabelValues("miss").Inc()
+	ch := searchCache.group.DoChan(k, func() (interface{}, error) {
+		generation := atomic.LoadUint64(&searchCache.generation)
+		rsp, err := fn(detachContext(ctx))
+		if err == nil {
+			searchCache.put(k, rsp, generation)
+		}
+		return rsp, err
+	})
+	select {
+	case <-ctx.Done():
+		return SearchRsp{}, ctx.Err()
+	case res := <-ch:
+		if res.Shared {
+			atomic.AddUint64(&searchCache.shared, 1)
+			cacheRequests.WithLabelValues("shared").Inc()
+		}
+		return res.Val.(SearchRsp), res.Err
+	}
+}
+
+func (c *resultCache) get(key string) (SearchRsp, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.index[key]
+	if !ok {
+		return SearchRsp{}, false
+	}
+	entry := e.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.entries.Remove(e)
+		delete(c.index, key)
+		return SearchRsp{}, false
+	}
+	c.entries.MoveToFront(e)
+	return entry.rsp, true
+}
+
+func (c *resultCache) put(key string, rsp SearchRsp, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != atomic.LoadUint64(&c.generation) {
+		return
+	}
+	expires := time.Now().Add(time.Duration(config.Cache.TTLSeconds) * time.Second)
+	if e, ok := c.index[key]; ok {
+		e.Value = &cacheEntry{key, rsp, expires}
+		c.entries.MoveToFront(e)
+		return
+	}
+	c.index[key] = c.entries.PushFront(&cacheEntry{key, rsp, expires})
+	for c.entries.Len() > config.Cache.Size {
+		last := c.entries.Back()
+		c.entries.Remove(last)
+		delete(c.index, last.Value.(*cacheEntry).key)
+		c.evictions++
+	}
+}
+
+// purge drops all the cached responses
+func (c *resultCache) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	atomic.AddUint64(&c.generation, 1)
+	c.entries.Init()
+	c.index = map[string]*list.Element{}
+}
+
+func (c *resultCache) stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := CacheStats{
+		Hits:      atomic.LoadUint64(&c.hits),
+		Misses:    atomic.LoadUint64(&c.misses),
+		Shared:    atomic.LoadUint64(&c.shared),
+		Evictions: c.evictions,
+		Entries:   c.entries.Len(),
+	}
+	if total := s.Hits + s.Misses; total != 0 {
+		s.HitRate = float64(s.Hits) / float64(total)
+	}
+	return s
+}
+
+// cacheStatsHandler reports the result cache hits and misses
+func cacheStatsHandler(w http.ResponseWriter, r *http.Request) {
+	jsonData, err := json.Marshal(searchCache.stats())
+	if err != nil {
+		http.Error(w, "Error converting data", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonData)
+}
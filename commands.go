@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+// command is one CLI subcommand of the backend binary
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]command{
+	"apikey": {"issue, revoke or list the API keys", apikeyCommand},
+	"eval":   {"evaluate the search relevance with a judgment list", evalCommand},
+	"import": {"import the items of a CSV or JSONL file", importCommand},
+	"index":  {"diff or apply the search index definitions", indexCommand},
+	"replay": {"replay the production queries against two configurations", replayCommand},
+}
+
+// runCommand runs the CLI subcommand and exits with its result
+func runCommand(name string, args []string) {
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q, the commands are:\n", name)
+		var names []string
+		for n := range commands {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		for _, n := range names {
+			fmt.Fprintf(os.Stderr, "  %-8s %s\n", n, commands[n].usage)
+		}
+		os.Exit(2)
+	}
+	if err := cmd.run(args); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+		os.Exit(1)
+	}
+}
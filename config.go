@@ -0,0 +1,425 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+)
+
+// Config holds the tunable search settings, the defaults can be
+// overwritten by the JSON file in the CONFIG_FILE environment variable
+type Config struct {
+	Boosts          BoostsConfig          `json:"boosts"`
+	Personalization PersonalizationConfig `json:"personalization"`
+	LearnedTags     LearnedTagsConfig     `json:"learnedTags"`
+	Blend           BlendConfig           `json:"blend"`
+	Experiment      ExperimentConfig      `json:"experiment"`
+	Startup         StartupConfig         `json:"startup"`
+	Watcher         WatcherConfig         `json:"watcher"`
+	Promotion       PromotionCacheConfig  `json:"promotion"`
+	Cache           ResultCacheConfig     `json:"cache"`
+	Timeouts        TimeoutsConfig        `json:"timeouts"`
+	Server          ServerConfig          `json:"server"`
+	Tracing         TracingConfig         `json:"tracing"`
+	Logging         LoggingConfig         `json:"logging"`
+	Limits          LimitsConfig          `json:"limits"`
+	RateLimit       RateLimitConfig       `json:"rateLimit"`
+	Auth            AuthConfig            `json:"auth"`
+}
+
+// FieldBoosts are the text search boosts by item field path
+type FieldBoosts map[string]float64
+
+// Paths gets the boosted paths, the highest boost first
+func (b FieldBoosts) Paths() []string {
+	var paths []string
+	for path, boost := range b {
+		if boost > 0 {
+			paths = append(paths, path)
+		}
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		if b[paths[i]] == b[paths[j]] {
+			return paths[i] < paths[j]
+		}
+		return b[paths[i]] > b[paths[j]]
+	})
+	return paths
+}
+
+// BoostsConfig are the user input keywords boosts of every search mode
+type BoostsConfig struct {
+	Search       FieldBoosts `json:"search"`
+	Personalized FieldBoosts `json:"personalized"`
+	Marketing    FieldBoosts `json:"marketing"`
+}
+
+// PersonalizationConfig controls how the user's view history is turned into
+// moreLikeThis clauses in the personalized search
+type PersonalizationConfig struct {
+	// MaxSignals is the max number of viewed items used as moreLikeThis clauses
+	MaxSignals int `json:"maxSignals"`
+	// HalfLifeHours is how many hours it takes a view to lose half of its weight
+	HalfLifeHours float64 `json:"halfLifeHours"`
+	// ViewCountWeight is the extra weight for every repeated view of the same item
+	ViewCountWeight float64 `json:"viewCountWeight"`
+	// MoreLikeThisBoost is the boost of the strongest signal, the others are scaled down by weight
+	MoreLikeThisBoost float64 `json:"moreLikeThisBoost"`
+	// MinBoost is the lowest boost a moreLikeThis clause gets
+	MinBoost float64 `json:"minBoost"`
+	// Fields are the item fields copied into the moreLikeThis like documents
+	Fields []string `json:"fields"`
+	// ProductTagBoost is the boost of items whose productTag matches the user's profile tags
+	ProductTagBoost float64 `json:"productTagBoost"`
+	// DiscountTagBoost is the boost of items whose discountTag matches the user's profile tags
+	DiscountTagBoost float64 `json:"discountTagBoost"`
+}
+
+// LearnedTagsConfig controls the background job learning the customers'
+// tags from their clicks
+type LearnedTagsConfig struct {
+	// IntervalMinutes is how often the job runs, 0 disables the job
+	IntervalMinutes int `json:"intervalMinutes"`
+	// HalfLifeHours is how many hours it takes the tag evidence to lose half of its weight
+	HalfLifeHours float64 `json:"halfLifeHours"`
+	// MinScore is the lowest evidence score a learned tag is kept with
+	MinScore float64 `json:"minScore"`
+	// MaxTags is the max number of learned tags kept per customer
+	MaxTags int `json:"maxTags"`
+	// MinConfidence is the lowest confidence a learned tag is used in personalization with
+	MinConfidence float64 `json:"minConfidence"`
+}
+
+// BlendConfig controls how the personalized search merges the organic and
+// the personalized results
+type BlendConfig struct {
+	// Strategy is one of compound, score, rrf and interleave
+	Strategy string `json:"strategy"`
+	// CandidateSize is the min number of items retrieved from each side
+	CandidateSize int `json:"candidateSize"`
+	// OrganicWeight is the weight of the organic results in score and rrf fusion
+	OrganicWeight float64 `json:"organicWeight"`
+	// PersonalizedWeight is the weight of the personalized results in score and rrf fusion
+	PersonalizedWeight float64 `json:"personalizedWeight"`
+	// RRFK is the rank constant of the reciprocal rank fusion
+	RRFK float64 `json:"rrfK"`
+	// PersonalizedSlots are the 1-based positions of every page given to the personalized results in interleave
+	PersonalizedSlots []int `json:"personalizedSlots"`
+}
+
+// ExperimentConfig is the running A/B experiment, an experiment without a
+// name or variants is disabled
+type ExperimentConfig struct {
+	Name     string          `json:"name"`
+	Variants []VariantConfig `json:"variants"`
+	// Modes are the search modes whose searches are in the experiment
+	Modes []string `json:"modes"`
+}
+
+// VariantConfig is one experiment variant, the empty fields keep the
+// configured defaults of the search mode
+type VariantConfig struct {
+	Name string `json:"name"`
+	// Weight is the variant's share of the users
+	Weight int `json:"weight"`
+	// Mode is one of search, search-p and search-m, empty keeps the mode of
+	// the endpoint
+	Mode   string      `json:"mode"`
+	Blend  string      `json:"blend"`
+	Boosts FieldBoosts `json:"boosts"`
+}
+
+// StartupConfig controls the collection and search index checks before
+// serving
+type StartupConfig struct {
+	// Mode is one of refuse, degrade and skip
+	Mode string `json:"mode"`
+	// RequiredFields are the item fields the search index must map
+	RequiredFields []string `json:"requiredFields"`
+	// RecheckSeconds is how often the search index is checked again while
+	// it's broken in degrade mode
+	RecheckSeconds int `json:"recheckSeconds"`
+}
+
+// WatcherConfig controls the change watchers of the items and
+// marketing_config collections
+type WatcherConfig struct {
+	Enabled bool `json:"enabled"`
+	// PollIntervalSeconds is the poll period when change streams are not
+	// supported
+	PollIntervalSeconds int `json:"pollIntervalSeconds"`
+}
+
+// PromotionCacheConfig controls the in-process promotion cache
+type PromotionCacheConfig struct {
+	// RefreshSeconds is the reload period, marketing_config changes reload
+	// it right away
+	RefreshSeconds int `json:"refreshSeconds"`
+}
+
+// ResultCacheConfig controls the search result cache
+type ResultCacheConfig struct {
+	// Size is the max number of cached responses, 0 disables the cache
+	Size       int `json:"size"`
+	TTLSeconds int `json:"ttlSeconds"`
+	// PerUser caches the personalized responses per user, they aren't
+	// cached by default
+	PerUser bool `json:"perUser"`
+}
+
+// TimeoutsConfig are the deadlines of the database operations in
+// milliseconds, 0 means no deadline
+type TimeoutsConfig struct {
+	// SearchMs bounds each search aggregation
+	SearchMs int `json:"searchMs"`
+	// ProfileMs bounds loading the personalization profile
+	ProfileMs int `json:"profileMs"`
+	// MoreLikeThisMs bounds the moreLikeThis recommendation of /search
+	MoreLikeThisMs int `json:"moreLikeThisMs"`
+	// ItemsMs bounds the item list
+	ItemsMs int `json:"itemsMs"`
+	// ReportMs bounds the click and query reports, the search history, the
+	// experiment report and the analytics event writes
+	ReportMs int `json:"reportMs"`
+}
+
+// ServerConfig controls the server startup and shutdown
+type ServerConfig struct {
+	// ConnectSeconds is how long the startup waits for MongoDB before
+	// checking and serving
+	ConnectSeconds int `json:"connectSeconds"`
+	// ShutdownSeconds is how long the shutdown waits for the in-flight
+	// requests and the background workers
+	ShutdownSeconds int `json:"shutdownSeconds"`
+}
+
+// TracingConfig controls the OpenTelemetry traces
+type TracingConfig struct {
+	// Exporter is one of none, stdout and otlp
+	Exporter string `json:"exporter"`
+	// Endpoint is the OTLP/HTTP collector host:port, empty uses the
+	// OTEL_EXPORTER_OTLP_ENDPOINT environment variable or localhost:4318
+	Endpoint string `json:"endpoint"`
+	Insecure bool   `json:"insecure"`
+	// SampleRatio is the share of the traces started here which are kept
+	SampleRatio float64 `json:"sampleRatio"`
+	ServiceName string  `json:"serviceName"`
+	// MongoStatements adds the MongoDB commands, with the user queries, to
+	// the spans
+	MongoStatements bool `json:"mongoStatements"`
+}
+
+// LoggingConfig controls the level, the format and the sinks of the logs
+type LoggingConfig struct {
+	// Level is one of trace, debug, info, warn and error
+	Level string `json:"level"`
+	// Format is json or text
+	Format string `json:"format"`
+	// Sinks are stdout and file
+	Sinks []string      `json:"sinks"`
+	File  LogFileConfig `json:"file"`
+	// SampleEvery writes one of every SampleEvery occurrences of the noisy
+	// per-request logs, 1 writes them all
+	SampleEvery int `json:"sampleEvery"`
+	// RedactFields are the log fields holding PII, they are replaced by a
+	// short hash
+	RedactFields []string `json:"redactFields"`
+}
+
+// LogFileConfig controls the rotation of the log file
+type LogFileConfig struct {
+	Path       string `json:"path"`
+	MaxSizeMB  int    `json:"maxSizeMB"`
+	MaxBackups int    `json:"maxBackups"`
+	MaxAgeDays int    `json:"maxAgeDays"`
+	Compress   bool   `json:"compress"`
+}
+
+// LimitsConfig bounds the request inputs, the requests beyond them are
+// answered 400
+type LimitsConfig struct {
+	MaxBodyBytes   int64 `json:"maxBodyBytes"`
+	MaxQueryLength int   `json:"maxQueryLength"`
+	MaxPage        int   `json:"maxPage"`
+	// MaxFieldLength bounds the user name and the click report fields
+	MaxFieldLength int `json:"maxFieldLength"`
+}
+
+// RateLimitConfig controls the per client token buckets of the routes
+type RateLimitConfig struct {
+	Enabled bool `json:"enabled"`
+	// Store is memory, a budget per instance, or mongo, a budget shared by
+	// all the instances
+	Store string `json:"store"`
+	// TrustProxy takes the client IP from the X-Forwarded-For header of the
+	// load balancer
+	TrustProxy bool       `json:"trustProxy"`
+	Search     RateBudget `json:"search"`
+	Click      RateBudget `json:"click"`
+	Admin      RateBudget `json:"admin"`
+	Probe      RateBudget `json:"probe"`
+}
+
+// RateBudget refills ratePerSecond tokens up to burst, every request takes
+// one. A 0 rate doesn't limit
+type RateBudget struct {
+	RatePerSecond float64 `json:"ratePerSecond"`
+	Burst         int     `json:"burst"`
+}
+
+// budget is the budget of the route class, with a burst of at least 1
+func (c RateLimitConfig) budget(class string) RateBudget {
+	var b RateBudget
+	switch class {
+	case RATE_SEARCH:
+		b = c.Search
+	case RATE_CLICK:
+		b = c.Click
+	case RATE_ADMIN:
+		b = c.Admin
+	case RATE_PROBE:
+		b = c.Probe
+	}
+	if b.Burst < 1 {
+		b.Burst = 1
+	}
+	return b
+}
+
+// AuthConfig controls the API keys of the admin, report and debug routes
+type AuthConfig struct {
+	// Enabled refuses the requests of these routes without a key of their
+	// roles, disabled serves them all anonymously
+	Enabled bool `json:"enabled"`
+	// CacheSeconds is how long a looked up key is kept, and so how long a
+	// revoked key may still be accepted
+	CacheSeconds int `json:"cacheSeconds"`
+	// LookupMs is the deadline of looking up a key in MongoDB
+	LookupMs int `json:"lookupMs"`
+	// UnknownCacheSeconds is how long an unknown key id is remembered, so
+	// the made up keys don't all reach MongoDB
+	UnknownCacheSeconds int `json:"unknownCacheSeconds"`
+	// Failures is the budget of invalid keys of a client IP, past it the IP
+	// gets 429 until the budget refills
+	Failures RateBudget `json:"failures"`
+}
+
+var config = defaultConfig()
+
+func defaultConfig() Config {
+	return Config{
+		Boosts: BoostsConfig{
+			Search:       FieldBoosts{"name2": 3, "name": 1, "discountTag": 1},
+			Personalized: FieldBoosts{"name2": 20, "name": 15, "discountTag": 1},
+			Marketing:    FieldBoosts{"name2": 20, "name": 15},
+		},
+		Personalization: PersonalizationConfig{
+			MaxSignals:        5,
+			HalfLifeHours:     72,
+			ViewCountWeight:   0.5,
+			MoreLikeThisBoost: 5,
+			MinBoost:          1,
+			Fields:            []string{"name", "name2", "discountTag", "productTag"},
+			ProductTagBoost:   3,
+			DiscountTagBoost:  2,
+		},
+		LearnedTags: LearnedTagsConfig{
+			IntervalMinutes: 30,
+			HalfLifeHours:   24 * 14,
+			MinScore:        0.1,
+			MaxTags:         10,
+			MinConfidence:   0.15,
+		},
+		Experiment: ExperimentConfig{
+			Modes: []string{MODE_SEARCH, MODE_PERSONALIZED},
+		},
+		Blend: BlendConfig{
+			Strategy:           BLEND_RRF,
+			CandidateSize:      30,
+			OrganicWeight:      1,
+			PersonalizedWeight: 0.5,
+			RRFK:               60,
+			PersonalizedSlots:  []int{3, 6, 9},
+		},
+		Startup: StartupConfig{
+			Mode:           STARTUP_DEGRADE,
+			RequiredFields: []string{"name", "name2", "discountTag", "productTag", "documentId"},
+			RecheckSeconds: 30,
+		},
+		Watcher: WatcherConfig{
+			Enabled:             true,
+			PollIntervalSeconds: 60,
+		},
+		Promotion: PromotionCacheConfig{
+			RefreshSeconds: 300,
+		},
+		Cache: ResultCacheConfig{
+			Size:       1000,
+			TTLSeconds: 60,
+		},
+		Timeouts: TimeoutsConfig{
+			SearchMs:       3000,
+			ProfileMs:      500,
+			MoreLikeThisMs: 1000,
+			ItemsMs:        2000,
+			ReportMs:       2000,
+		},
+		Server: ServerConfig{
+			ConnectSeconds:  60,
+			ShutdownSeconds: 30,
+		},
+		Tracing: TracingConfig{
+			Exporter:    TRACE_NONE,
+			SampleRatio: 1,
+			ServiceName: "atlas-search-demo",
+		},
+		Logging: LoggingConfig{
+			Level:  "info",
+			Format: LOG_JSON,
+			Sinks:  []string{LOG_FILE},
+			File: LogFileConfig{
+				Path:       "logrus.log",
+				MaxSizeMB:  100,
+				MaxBackups: 5,
+				MaxAgeDays: 30,
+			},
+			SampleEvery:  100,
+			RedactFields: []string{"user", "body"},
+		},
+		Limits: LimitsConfig{
+			MaxBodyBytes:   4096,
+			MaxQueryLength: 200,
+			MaxPage:        100,
+			MaxFieldLength: 256,
+		},
+		RateLimit: RateLimitConfig{
+			Enabled: true,
+			Store:   RATE_STORE_MEMORY,
+			Search:  RateBudget{RatePerSecond: 5, Burst: 20},
+			Click:   RateBudget{RatePerSecond: 10, Burst: 30},
+			Admin:   RateBudget{RatePerSecond: 1, Burst: 10},
+			Probe:   RateBudget{RatePerSecond: 2, Burst: 10},
+		},
+		Auth: AuthConfig{
+			Enabled:             true,
+			CacheSeconds:        30,
+			LookupMs:            500,
+			UnknownCacheSeconds: 5,
+			Failures:            RateBudget{RatePerSecond: 0.1, Burst: 10},
+		},
+	}
+}
+
+// loadConfig reads the JSON config file on top of the default config, the
+// fields missing in the file keep their default values
+func loadConfig(path string) (Config, error) {
+	c := defaultConfig()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return c, err
+	}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return c, err
+	}
+	return c, nil
+}
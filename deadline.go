@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// withDeadline derives the context of one operation with its configured
+// deadline in milliseconds, 0 means no deadline of its own
+func withDeadline(ctx context.Context, ms int) (context.Context, context.CancelFunc) {
+	if ms <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, time.Duration(ms)*time.Millisecond)
+}
+
+// isTimeout tells if the operation failed on its deadline
+func isTimeout(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded) || mongo.IsTimeout(err)
+}
+
+// writeSearchRsp writes the search response. A failed optional retrieval
+// answers the primary results as partial, even when there are none, and a
+// timeout of a required one answers 504, with the partial results when there
+// are any. It tells if results were written
+func writeSearchRsp(w http.ResponseWriter, r *http.Request, rsp SearchRsp, err error) bool {
+	status := http.StatusOK
+	if err != nil {
+		countError(r.Context(), err)
+	}
+	var degraded *DegradedError
+	switch {
+	case err == nil:
+	case errors.Is(err, context.Canceled) && r.Context().Err() != nil:
+		// The client is gone, nobody reads the response
+		return false
+	case errors.As(err, &degraded):
+		// Only optional retrievals failed, answer the primary results. It's
+		// checked first as the retrieval's timeout is wrapped in it
+		log.WithContext(r.Context()).WithFields(
+			logrus.Fields{
+				"path": r.URL.Path,
+				"err":  err,
+			}).Warn("search degraded")
+		rsp.Partial = true
+		rsp.Degraded = degraded.Retrievals
+	case isTimeout(err):
+		log.WithContext(r.Context()).WithFields(
+			logrus.Fields{
+				"path": r.URL.Path,
+				"err":  err,
+			}).Warn("search timed out")
+		if len(rsp.SearchResults) == 0 && len(rsp.MoreLikeThisResults) == 0 {
+			http.Error(w, "Search timed out", http.StatusGatewayTimeout)
+			return false
+		}
+		rsp.Partial = true
+		status = http.StatusGatewayTimeout
+	default:
+		log.WithContext(r.Context()).WithFields(
+			logrus.Fields{
+				"path": r.URL.Path,
+				"err":  err,
+			}).Error("search failed")
+		http.Error(w, "Error searching items", http.StatusInternalServerError)
+		return false
+	}
+
+	// Convert the data to JSON
+	jsonData, err := json.Marshal(rsp)
+	if err != nil {
+		http.Error(w, "Error converting data", http.StatusInternalServerError)
+		return false
+	}
+	// Set the Content-Type and write the JSON response
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(jsonData)
+	return true
+}
+
+// dbFailed answers 504 when the database operation timed out, and 500
+// otherwise
+func dbFailed(w http.ResponseWriter, r *http.Request, message string, err error) {
+	countError(r.Context(), err)
+	status := http.StatusInternalServerError
+	if isTimeout(err) {
+		status = http.StatusGatewayTimeout
+	}
+	log.WithContext(r.Context()).WithFields(
+		logrus.Fields{
+			"err": err,
+		}).Error(message)
+	http.Error(w, message, status)
+}
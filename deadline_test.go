@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestWriteSearchRsp(t *testing.T) {
+	log = logrus.New()
+	log.SetOutput(io.Discard)
+	hits := SearchRsp{SearchResults: Results{{Item: Item{DocumentId: "a"}}}}
+	tests := []struct {
+		name         string
+		rsp          SearchRsp
+		err          error
+		canceled     bool
+		wantWritten  bool
+		wantCode     int
+		wantPartial  bool
+		wantDegraded []string
+	}{
+		{
+			name:        "results",
+			rsp:         hits,
+			wantWritten: true,
+			wantCode:    http.StatusOK,
+		},
+		{
+			name:         "degraded answers the primary results",
+			rsp:          hits,
+			err:          &DegradedError{Retrievals: []string{"personalized"}, Err: errors.New("boom")},
+			wantWritten:  true,
+			wantCode:     http.StatusOK,
+			wantPartial:  true,
+			wantDegraded: []string{"personalized"},
+		},
+		{
+			name:         "degraded by a timeout without hits",
+			err:          &DegradedError{Retrievals: []string{"moreLikeThis"}, Err: context.DeadlineExceeded},
+			wantWritten:  true,
+			wantCode:     http.StatusOK,
+			wantPartial:  true,
+			wantDegraded: []string{"moreLikeThis"},
+		},
+		{
+			name:        "timeout with partial results",
+			rsp:         hits,
+			err:         context.DeadlineExceeded,
+			wantWritten: true,
+			wantCode:    http.StatusGatewayTimeout,
+			wantPartial: true,
+		},
+		{
+			name:     "timeout without results",
+			err:      context.DeadlineExceeded,
+			wantCode: http.StatusGatewayTimeout,
+		},
+		{
+			name:     "failure",
+			rsp:      hits,
+			err:      errors.New("boom"),
+			wantCode: http.StatusInternalServerError,
+		},
+		{
+			name:     "client gone",
+			err:      context.Canceled,
+			canceled: true,
+			wantCode: http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/search?query=a", nil)
+			if tt.canceled {
+				ctx, cancel := context.WithCancel(req.Context())
+				cancel()
+				req = req.WithContext(ctx)
+			}
+			rec := httptest.NewRecorder()
+			written := writeSearchRsp(rec, req, tt.rsp, tt.err)
+			if written != tt.wantWritten || rec.Code != tt.wantCode {
+				t.Fatalf("written %v with %d, want %v with %d", written, rec.Code, tt.wantWritten, tt.wantCode)
+			}
+			if !written {
+				return
+			}
+			var got SearchRsp
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatalf("response %q: %v", rec.Body.String(), err)
+			}
+			if got.Partial != tt.wantPartial || !reflect.DeepEqual(got.Degraded, tt.wantDegraded) {
+				t.Errorf("partial %v degraded %v, want %v %v", got.Partial, got.Degraded, tt.wantPartial, tt.wantDegraded)
+			}
+			if len(got.SearchResults) != len(tt.rsp.SearchResults) {
+				t.Errorf("%d results, want %d", len(got.SearchResults), len(tt.rsp.SearchResults))
+			}
+		})
+	}
+}
+
+// slowOrganicSearcher answers the personalized retrieval at once and holds
+// the organic one until its deadline
+type slowOrganicSearcher struct{}
+
+func (slowOrganicSearcher) Aggregate(ctx context.Context, pipeline []bson.D) ([]bson.M, error) {
+	if strings.Contains(fmt.Sprint(pipeline), "moreLikeThis") {
+		return blendItems("p", 3.0, "q", 2.0), nil
+	}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestBlendSearchRequiredTimeout(t *testing.T) {
+	log = logrus.New()
+	log.SetOutput(io.Discard)
+	savedConfig := config
+	defer func() { config = savedConfig }()
+	config = defaultConfig()
+	config.Timeouts.SearchMs = 50
+
+	profile := &PersonalizationProfile{Signals: []PersonalizationSignal{{Like: bson.M{"name": "a"}, Boost: 1}}}
+	opts := defaultSearchOptions(MODE_PERSONALIZED)
+	opts.Blend = BLEND_RRF
+	results, _, err := blendSearch(context.Background(), slowOrganicSearcher{}, "a", 1, staticProfile(profile), opts)
+	if !isTimeout(err) || isDegraded(err) {
+		t.Fatalf("err is %v, want the organic timeout", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/search-p?query=a", nil)
+	rec := httptest.NewRecorder()
+	if !writeSearchRsp(rec, req, SearchRsp{SearchResults: toResults(results)}, err) || rec.Code != http.StatusGatewayTimeout {
+		t.Fatalf("answered %d, want %d with the partial results", rec.Code, http.StatusGatewayTimeout)
+	}
+	var got SearchRsp
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("response %q: %v", rec.Body.String(), err)
+	}
+	if !got.Partial || len(got.SearchResults) != 2 {
+		t.Errorf("partial %v with %d results, want the 2 personalized results", got.Partial, len(got.SearchResults))
+	}
+	for _, hit := range got.SearchResults {
+		if hit.Source != SOURCE_PERSONALIZED {
+			t.Errorf("%s is from %s, want %s", hit.DocumentId, hit.Source, SOURCE_PERSONALIZED)
+		}
+	}
+}
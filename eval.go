@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const EVAL_K = 10
+
+// Judgment is the graded relevance of one item for one query, grade 0
+// means not relevant
+type Judgment struct {
+	Query      string
+	DocumentId string
+	Grade      float64
+}
+
+// QueryMetrics are the relevance metrics of one query
+type QueryMetrics struct {
+	Query  string
+	NDCG   float64
+	MRR    float64
+	Recall float64
+}
+
+// evalCommand runs the judged queries through the pipeline builders, and
+// reports NDCG@10, MRR and recall@10 of one or two configurations
+func evalCommand(args []string) error {
+	fs := flag.NewFlagSet("eval", flag.ExitOnError)
+	judgmentsPath := fs.String("judgments", "", "judgment CSV file with query,documentId,grade rows")
+	mode := fs.String("mode", MODE_SEARCH, "search mode: search, search-p or search-m")
+	itemsPath := fs.String("items", "", "items JSONL file for the in-memory store, empty searches the cluster")
+	configPath := fs.String("config", "", "config file of the evaluated configuration, empty uses the current config")
+	comparePath := fs.String("compare", "", "config file of the configuration compared with")
+	user := fs.String("user", "", "user whose profile personalizes search-p, empty searches without profile")
+	fs.Parse(args)
+
+	if *judgmentsPath == "" {
+		return fmt.Errorf("the -judgments file is required")
+	}
+	judgments, err := loadJudgments(*judgmentsPath)
+	if err != nil {
+		return err
+	}
+	searcher, err := openSearcher(*itemsPath)
+	if err != nil {
+		return err
+	}
+	if *user != "" && *itemsPath != "" {
+		// The profiles are in the cluster, the items file has none
+		fmt.Fprintf(os.Stderr, "-user %s ignored, the in-memory store has no profiles\n", *user)
+		*user = ""
+	}
+
+	base, err := configFor(*configPath)
+	if err != nil {
+		return err
+	}
+	a, err := evaluate(searcher, base, *mode, *user, judgments)
+	if err != nil {
+		return err
+	}
+	if *comparePath == "" {
+		printMetrics(os.Stdout, a)
+		return nil
+	}
+
+	candidate, err := configFor(*comparePath)
+	if err != nil {
+		return err
+	}
+	b, err := evaluate(searcher, candidate, *mode, *user, judgments)
+	if err != nil {
+		return err
+	}
+	printComparison(os.Stdout, a, b)
+	return nil
+}
+
+// openSearcher gets the in-memory store of the items file, or the cluster
+// searcher without one
+func openSearcher(itemsPath string) (Searcher, error) {
+	if itemsPath != "" {
+		return loadMemoryStore(itemsPath)
+	}
+	return newMongoSearcher()
+}
+
+// configFor loads the config file, an empty path is the current config
+func configFor(path string) (Config, error) {
+	if path == "" {
+		return config, nil
+	}
+	return loadConfig(path)
+}
+
+// loadJudgments reads the query,documentId,grade CSV file, the header row
+// is optional
+func loadJudgments(path string) (map[string][]Judgment, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	judgments := map[string][]Judgment{}
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = 3
+	reader.TrimLeadingSpace = true
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		grade, err := strconv.ParseFloat(record[2], 64)
+		if err != nil {
+			if line == 1 {
+				continue
+			}
+			return nil, fmt.Errorf("line %d: bad grade %q", line, record[2])
+		}
+		j := Judgment{Query: record[0], DocumentId: record[1], Grade: grade}
+		judgments[j.Query] = append(judgments[j.Query], j)
+	}
+	return judgments, nil
+}
+
+// runSearch runs the query's first page through the pipeline builders of
+// the search mode
+func runSearch(ctx context.Context, searcher Searcher, mode, query string, opts SearchOptions, profile *PersonalizationProfile) ([]bson.M, error) {
+	switch mode {
+	case MODE_PERSONALIZED:
+		if opts.Blend != BLEND_COMPOUND {
+			results, _, err := blendSearch(ctx, searcher, query, 1, staticProfile(profile), opts)
+			return results, err
+		}
+		return searcher.Aggregate(ctx, pipelineP(query, 1, profile, opts))
+	case MODE_MARKETING:
+		return searcher.Aggregate(ctx, pipelineM(query, 1, nil, opts.Boosts))
+	default:
+		return searcher.Aggregate(ctx, pipeline(query, 1, opts.Boosts))
+	}
+}
+
+// evaluate runs every judged query with the configuration, the pipeline
+// builders and the user's profile read the global config so it's swapped in
+// during the run
+func evaluate(searcher Searcher, c Config, mode, user string, judgments map[string][]Judgment) (metrics []QueryMetrics, err error) {
+	var queries []string
+	for q := range judgments {
+		queries = append(queries, q)
+	}
+	sort.Strings(queries)
+
+	withConfig(c, func() {
+		var profile *PersonalizationProfile
+		if profile, err = evalProfile(user); err != nil {
+			return
+		}
+		for _, q := range queries {
+			var results []bson.M
+			results, err = runSearch(context.Background(), searcher, mode, q, defaultSearchOptions(mode), profile)
+			if err != nil {
+				err = fmt.Errorf("query %q: %w", q, err)
+				return
+			}
+			metrics = append(metrics, scoreQuery(q, documentIds(results), judgments[q], EVAL_K))
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return metrics, nil
+}
+
+// evalProfile builds the user's profile with the current config, a user
+// without a profile is evaluated without personalization
+func evalProfile(user string) (*PersonalizationProfile, error) {
+	if user == "" {
+		return nil, nil
+	}
+	profile, err := getPersonalizationProfile(context.Background(), user)
+	if err == mongo.ErrNoDocuments {
+		fmt.Fprintf(os.Stderr, "user %s has no profile, evaluated without personalization\n", user)
+		return nil, nil
+	}
+	return profile, err
+}
+
+func documentIds(results []bson.M) []string {
+	var IDs []string
+	for _, r := range results {
+		id, _ := r["documentId"].(string)
+		IDs = append(IDs, id)
+	}
+	return IDs
+}
+
+// scoreQuery computes NDCG@k, MRR and recall@k of the ranked documents
+func scoreQuery(query string, ranked []string, judgments []Judgment, k int) QueryMetrics {
+	grades := map[string]float64{}
+	var ideal []float64
+	for _, j := range judgments {
+		grades[j.DocumentId] = j.Grade
+		if j.Grade > 0 {
+			ideal = append(ideal, j.Grade)
+		}
+	}
+	m := QueryMetrics{Query: query}
+	if len(ideal) == 0 {
+		return m
+	}
+	if len(ranked) > k {
+		ranked = ranked[:k]
+	}
+
+	dcg, found := 0.0, 0
+	for i, id := range ranked {
+		g := grades[id]
+		if g <= 0 {
+			continue
+		}
+		dcg += (math.Pow(2, g) - 1) / math.Log2(float64(i+2))
+		found++
+		if m.MRR == 0 {
+			m.MRR = 1 / float64(i+1)
+		}
+	}
+
+	sort.Sort(sort.Reverse(sort.Float64Slice(ideal)))
+	idcg := 0.0
+	for i, g := range ideal {
+		if i == k {
+			break
+		}
+		idcg += (math.Pow(2, g) - 1) / math.Log2(float64(i+2))
+	}
+	m.NDCG = dcg / idcg
+	m.Recall = float64(found) / float64(len(ideal))
+	return m
+}
+
+func meanMetrics(metrics []QueryMetrics) QueryMetrics {
+	mean := QueryMetrics{Query: "MEAN"}
+	if len(metrics) == 0 {
+		return mean
+	}
+	for _, m := range metrics {
+		mean.NDCG += m.NDCG
+		mean.MRR += m.MRR
+		mean.Recall += m.Recall
+	}
+	n := float64(len(metrics))
+	mean.NDCG, mean.MRR, mean.Recall = mean.NDCG/n, mean.MRR/n, mean.Recall/n
+	return mean
+}
+
+func printMetrics(out io.Writer, metrics []QueryMetrics) {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "QUERY\tNDCG@10\tMRR\tRECALL@10")
+	for _, m := range append(metrics, meanMetrics(metrics)) {
+		fmt.Fprintf(w, "%s\t%.4f\t%.4f\t%.4f\n", m.Query, m.NDCG, m.MRR, m.Recall)
+	}
+	w.Flush()
+}
+
+// printComparison prints the two configurations' metrics side by side with
+// the candidate's change
+func printComparison(out io.Writer, a, b []QueryMetrics) {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "QUERY\tNDCG@10 A\tNDCG@10 B\tΔ\tMRR A\tMRR B\tΔ\tRECALL A\tRECALL B\tΔ")
+	a = append(a, meanMetrics(a))
+	b = append(b, meanMetrics(b))
+	for i := range a {
+		fmt.Fprintf(w, "%s\t%.4f\t%.4f\t%s\t%.4f\t%.4f\t%s\t%.4f\t%.4f\t%s\n", a[i].Query,
+			a[i].NDCG, b[i].NDCG, delta(a[i].NDCG, b[i].NDCG),
+			a[i].MRR, b[i].MRR, delta(a[i].MRR, b[i].MRR),
+			a[i].Recall, b[i].Recall, delta(a[i].Recall, b[i].Recall))
+	}
+	w.Flush()
+}
+
+func delta(a, b float64) string {
+	d := b - a
+	if math.Abs(d) < 0.00005 {
+		return "="
+	}
+	return strings.TrimRight(strings.TrimRight(fmt.Sprintf("%+.4f", d), "0"), ".")
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestScoreQuery(t *testing.T) {
+	tests := []struct {
+		name      string
+		ranked    []string
+		judgments []Judgment
+		k         int
+		want      QueryMetrics
+	}{
+		{
+			name:      "ideal ranking",
+			ranked:    []string{"a", "b", "x"},
+			judgments: []Judgment{{DocumentId: "a", Grade: 3}, {DocumentId: "b", Grade: 1}},
+			k:         10,
+			want:      QueryMetrics{NDCG: 1, MRR: 1, Recall: 1},
+		},
+		{
+			name:      "swapped grades",
+			ranked:    []string{"b", "a"},
+			judgments: []Judgment{{DocumentId: "a", Grade: 3}, {DocumentId: "b", Grade: 1}},
+			k:         10,
+			want: QueryMetrics{
+				NDCG:   (1 + 7/math.Log2(3)) / (7 + 1/math.Log2(3)),
+				MRR:    1,
+				Recall: 1,
+			},
+		},
+		{
+			name:      "first relevant third",
+			ranked:    []string{"x", "y", "a"},
+			judgments: []Judgment{{DocumentId: "a", Grade: 2}},
+			k:         10,
+			want:      QueryMetrics{NDCG: 0.5, MRR: 1.0 / 3, Recall: 1},
+		},
+		{
+			name:      "relevant below k",
+			ranked:    []string{"x", "y", "a"},
+			judgments: []Judgment{{DocumentId: "a", Grade: 2}},
+			k:         2,
+			want:      QueryMetrics{},
+		},
+		{
+			name:      "half of the relevant found",
+			ranked:    []string{"a"},
+			judgments: []Judgment{{DocumentId: "a", Grade: 1}, {DocumentId: "b", Grade: 1}},
+			k:         10,
+			want:      QueryMetrics{NDCG: 1 / (1 + 1/math.Log2(3)), MRR: 1, Recall: 0.5},
+		},
+		{
+			name:      "no relevant judgment",
+			ranked:    []string{"a"},
+			judgments: []Judgment{{DocumentId: "a", Grade: 0}},
+			k:         10,
+			want:      QueryMetrics{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := scoreQuery("q", tt.ranked, tt.judgments, tt.k)
+			if got.Query != "q" {
+				t.Errorf("query is %q, want q", got.Query)
+			}
+			for _, m := range []struct {
+				name      string
+				got, want float64
+			}{
+				{"NDCG", got.NDCG, tt.want.NDCG},
+				{"MRR", got.MRR, tt.want.MRR},
+				{"recall", got.Recall, tt.want.Recall},
+			} {
+				if math.Abs(m.got-m.want) > 1e-9 {
+					t.Errorf("%s is %v, want %v", m.name, m.got, m.want)
+				}
+			}
+		})
+	}
+}
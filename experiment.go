@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"hash/fnv"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// EXPERIMENT_ATTRIBUTION_WINDOW is how long after a variant's search the
+// user's clicks are the variant's
+const EXPERIMENT_ATTRIBUTION_WINDOW = 30 * time.Minute
+
+// VariantReport is the experiment result of one variant
+type VariantReport struct {
+	Variant        string  `json:"variant"`
+	Searches       int     `json:"searches"`
+	Clicks         int     `json:"clicks"`
+	ZeroResults    int     `json:"zeroResults"`
+	CTR            float64 `json:"ctr"`
+	ZeroResultRate float64 `json:"zeroResultRate"`
+}
+
+// experimentEnabled tells if an experiment is configured
+func experimentEnabled() bool {
+	return config.Experiment.Name != "" && len(config.Experiment.Variants) != 0
+}
+
+// assignVariant gets the user's variant by hashing the user with the
+// experiment name, the same user always gets the same variant
+func assignVariant(user string) *VariantConfig {
+	if !experimentEnabled() {
+		return nil
+	}
+	variants := config.Experiment.Variants
+	total := 0
+	for _, v := range variants {
+		total += v.Weight
+	}
+	if total <= 0 {
+		return nil
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(config.Experiment.Name + "/" + user))
+	bucket := int(h.Sum32() % uint32(total))
+	for i := range variants {
+		if bucket < variants[i].Weight {
+			return &variants[i]
+		}
+		bucket -= variants[i].Weight
+	}
+	return nil
+}
+
+// experimentIncludes tells if the searches of the mode are in the running
+// experiment
+func experimentIncludes(mode string) bool {
+	if !experimentEnabled() {
+		return false
+	}
+	for _, m := range config.Experiment.Modes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// userVariant gets the user's variant, and the search mode and options of
+// the variant. The variant's empty fields keep the endpoint's mode and
+// options, outside the experiment the variant is nil
+func userVariant(ctx context.Context, user, mode string, opts SearchOptions) (*VariantConfig, string, SearchOptions) {
+	v := assignVariant(user)
+	if v == nil {
+		return nil, mode, opts
+	}
+	if v.Mode != "" && v.Mode != mode {
+		mode = v.Mode
+		opts = defaultSearchOptions(mode)
+		setMetricsMode(ctx, mode)
+	}
+	if v.Blend != "" {
+		opts.Blend = v.Blend
+	}
+	if len(v.Boosts) != 0 {
+		opts.Boosts = v.Boosts
+	}
+	return v, mode, opts
+}
+
+// recordSearch records the search event, tagged with the variant which
+// served it, nil outside the experiment
+func recordSearch(user string, variant *VariantConfig, mode, query string, results int) {
+	e := Event{Type: EVENT_SEARCH, User: user, Mode: mode, Query: query, Results: results}
+	if results == 0 {
+		zeroResultSearches.WithLabelValues(mode).Inc()
+	}
+	if variant != nil {
+		e.Experiment, e.Variant = config.Experiment.Name, variant.Name
+	}
+	recordEvent(e)
+}
+
+// recordClick records the click event. Its variant is the one of the user's
+// latest search, found in the events by the experiment report. It has the
+// view time of the click's viewHistory entry, so the tag learner counts the
+// click once
+func recordClick(user string, click ItemReport) {
+	recordEvent(Event{Type: EVENT_CLICK, User: user, DocumentId: click.DocumentId, Time: click.ViewTime})
+}
+
+// experimentSearchHandler is the /search of the first experiments, the
+// search endpoints serve the variants now
+func experimentSearchHandler(w http.ResponseWriter, r *http.Request) {
+	v := &validator{}
+	page := v.page(r)
+	query := v.query(r)
+	user := v.user(r)
+	if v.reject(w) {
+		return
+	}
+	if !authorizeUser(w, r, user) {
+		return
+	}
+	serveSearch(w, r, user, query, page, MODE_SEARCH, defaultSearchOptions(MODE_SEARCH), true)
+}
+
+// experimentReportHandler reports the CTR and zero result rate of every
+// variant in the running experiment
+func experimentReportHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("experiment")
+	if name == "" {
+		name = config.Experiment.Name
+	}
+	ctx, cancel := withDeadline(r.Context(), config.Timeouts.ReportMs)
+	defer cancel()
+	reports, err := experimentReport(ctx, name)
+	if err != nil {
+		dbFailed(w, r, "Error getting experiment report", err)
+		return
+	}
+
+	// Convert the data to JSON
+	jsonData, err := json.Marshal(reports)
+	if err != nil {
+		http.Error(w, "Error converting data", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonData)
+}
+
+// experimentReport counts the searches, clicks and zero result searches of
+// every variant of the experiment. A click is the variant's when the user's
+// latest search before it, within the attribution window, is the variant's
+func experimentReport(ctx context.Context, name string) ([]VariantReport, error) {
+	client, err := GetMongoClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	collection := client.Database(DB).Collection(EVENT_COLLECTION)
+	ensureEventUserIndex(ctx, collection)
+
+	matchStage := bson.D{{"$match", bson.D{{"experiment", name}, {"type", EVENT_SEARCH}}}}
+	groupStage := bson.D{{"$group", bson.D{
+		{"_id", "$variant"},
+		{"searches", bson.D{{"$sum", 1}}},
+		{"zeroResults", bson.D{{"$sum", bson.D{{"$cond", bson.A{bson.D{{"$eq", bson.A{"$results", 0}}}, 1, 0}}}}}},
+		{"start", bson.D{{"$min", "$time"}}},
+	}}}
+	sortStage := bson.D{{"$sort", bson.D{{"_id", 1}}}}
+
+	cursor, err := collection.Aggregate(ctx, bson.A{matchStage, groupStage, sortStage})
+	if err != nil {
+		log.WithContext(ctx).WithFields(
+			logrus.Fields{
+				"experiment": name,
+				"err":        err,
+			}).Error("aggregate experiment events failed")
+		return nil, err
+	}
+	var groups []struct {
+		Variant     string    `bson:"_id"`
+		Searches    int       `bson:"searches"`
+		ZeroResults int       `bson:"zeroResults"`
+		Start       time.Time `bson:"start"`
+	}
+	if err = cursor.All(ctx, &groups); err != nil {
+		return nil, err
+	}
+	reports := []VariantReport{}
+	if len(groups) == 0 {
+		return reports, nil
+	}
+
+	start := groups[0].Start
+	for _, g := range groups {
+		if g.Start.Before(start) {
+			start = g.Start
+		}
+	}
+	clicks, err := experimentClicks(ctx, collection, name, start)
+	if err != nil {
+		log.WithContext(ctx).WithFields(
+			logrus.Fields{
+				"experiment": name,
+				"err":        err,
+			}).Error("attribute experiment clicks failed")
+		return nil, err
+	}
+
+	for _, g := range groups {
+		report := VariantReport{
+			Variant:     g.Variant,
+			Searches:    g.Searches,
+			Clicks:      clicks[g.Variant],
+			ZeroResults: g.ZeroResults,
+		}
+		if g.Searches > 0 {
+			report.CTR = float64(report.Clicks) / float64(g.Searches)
+			report.ZeroResultRate = float64(g.ZeroResults) / float64(g.Searches)
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+// experimentClicks counts the clicks since the experiment's start by the
+// variant of the user's latest search before each, within the attribution
+// window
+func experimentClicks(ctx context.Context, collection *mongo.Collection, name string, start time.Time) (map[string]int, error) {
+	matchStage := bson.D{{"$match", bson.D{{"type", EVENT_CLICK}, {"time", bson.D{{"$gte", start}}}}}}
+	lookupStage := bson.D{{"$lookup", bson.D{
+		{"from", EVENT_COLLECTION},
+		{"let", bson.D{{"user", "$name"}, {"clicked", "$time"}}},
+		{"pipeline", bson.A{
+			bson.D{{"$match", bson.D{{"$expr", bson.D{{"$and", bson.A{
+				bson.D{{"$eq", bson.A{"$name", "$$user"}}},
+				bson.D{{"$eq", bson.A{"$type", EVENT_SEARCH}}},
+				bson.D{{"$lte", bson.A{"$time", "$$clicked"}}},
+				bson.D{{"$gte", bson.A{"$time", bson.D{{"$subtract", bson.A{"$$clicked", EXPERIMENT_ATTRIBUTION_WINDOW.Milliseconds()}}}}}},
+			}}}}}}},
+			bson.D{{"$sort", bson.D{{"time", -1}}}},
+			bson.D{{"$limit", 1}},
+			bson.D{{"$project", bson.D{{"experiment", 1}, {"variant", 1}}}},
+		}},
+		{"as", "search"},
+	}}}
+	unwindStage := bson.D{{"$unwind", "$search"}}
+	attributedStage := bson.D{{"$match", bson.D{{"search.experiment", name}}}}
+	groupStage := bson.D{{"$group", bson.D{{"_id", "$search.variant"}, {"clicks", bson.D{{"$sum", 1}}}}}}
+
+	cursor, err := collection.Aggregate(ctx, bson.A{matchStage, lookupStage, unwindStage, attributedStage, groupStage})
+	if err != nil {
+		return nil, err
+	}
+	var groups []struct {
+		Variant string `bson:"_id"`
+		Clicks  int    `bson:"clicks"`
+	}
+	if err = cursor.All(ctx, &groups); err != nil {
+		return nil, err
+	}
+	clicks := map[string]int{}
+	for _, g := range groups {
+		clicks[g.Variant] = g.Clicks
+	}
+	return clicks, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Retrieval is one of the independent retrievals of a search
+type Retrieval struct {
+	Name string
+	// Required fails the search when it fails, the optional retrievals only
+	// degrade it
+	Required bool
+	Run      func(context.Context) error
+}
+
+// DegradedError lists the optional retrievals which failed, the search
+// still has the results of the others
+type DegradedError struct {
+	Retrievals []string
+	Err        error
+}
+
+func (e *DegradedError) Error() string {
+	return fmt.Sprintf("%s failed: %v", strings.Join(e.Retrievals, ", "), e.Err)
+}
+
+func (e *DegradedError) Unwrap() error {
+	return e.Err
+}
+
+// isDegraded tells if only optional retrievals failed
+func isDegraded(err error) bool {
+	var degraded *DegradedError
+	return errors.As(err, &degraded)
+}
+
+// fanOut runs the retrievals concurrently with the shared deadline in
+// milliseconds. A failed required retrieval cancels the others and is
+// returned, the failed optional ones are returned as a DegradedError
+func fanOut(ctx context.Context, deadlineMs int, retrievals ...Retrieval) error {
+	ctx, cancel := withDeadline(ctx, deadlineMs)
+	defer cancel()
+
+	errs := make([]error, len(retrievals))
+	var wg sync.WaitGroup
+	for i, r := range retrievals {
+		wg.Add(1)
+		go func(i int, r Retrieval) {
+			defer wg.Done()
+			errs[i] = r.Run(ctx)
+			if errs[i] != nil && r.Required {
+				cancel()
+			}
+		}(i, r)
+	}
+	wg.Wait()
+
+	var degraded *DegradedError
+	for i, r := range retrievals {
+		if errs[i] == nil {
+			continue
+		}
+		if r.Required {
+			return errs[i]
+		}
+		log.WithContext(ctx).WithFields(
+			logrus.Fields{
+				"retrieval": r.Name,
+				"err":       errs[i],
+			}).Warn("optional retrieval failed, degrading the search")
+		if degraded == nil {
+			degraded = &DegradedError{Err: errs[i]}
+		}
+		degraded.Retrievals = append(degraded.Retrievals, r.Name)
+	}
+	if degraded != nil {
+		return degraded
+	}
+	return nil
+}
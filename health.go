@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// HEALTH_CHECK_TIMEOUT bounds every dependency check of the probes
+const HEALTH_CHECK_TIMEOUT = 2 * time.Second
+
+// HEALTH_INDEX_CACHE is how long the probes reuse the search index check,
+// every check lists the Atlas search indexes
+const HEALTH_INDEX_CACHE = 5 * time.Second
+
+// Reasons of the failed dependency checks, the errors themselves are only
+// logged
+const (
+	HEALTH_UNREACHABLE     = "unreachable"
+	HEALTH_TIMEOUT         = "timeout"
+	HEALTH_INDEX_MISSING   = "index_missing"
+	HEALTH_INDEX_NOT_READY = "index_not_ready"
+	HEALTH_NOT_LOADED      = "not_loaded"
+)
+
+// version is the build version, set with
+// go build -ldflags "-X main.version=1.2.3"
+var version = ""
+
+var startedAt = time.Now()
+
+// DependencyStatus is the result of one dependency check
+type DependencyStatus struct {
+	Name      string  `json:"name"`
+	OK        bool    `json:"ok"`
+	LatencyMs float64 `json:"latencyMs"`
+	Reason    string  `json:"reason,omitempty"`
+}
+
+// Status is the /status response
+type Status struct {
+	Version       string             `json:"version"`
+	ConfigHash    string             `json:"configHash"`
+	StartedAt     time.Time          `json:"startedAt"`
+	UptimeSeconds float64            `json:"uptimeSeconds"`
+	Ready         bool               `json:"ready"`
+	Dependencies  []DependencyStatus `json:"dependencies"`
+}
+
+// buildVersion gets the version set at build time, or the VCS revision the
+// go command stamps into the binary
+func buildVersion() string {
+	if version != "" {
+		return version
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	revision, modified := "", false
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			revision = s.Value
+		case "vcs.modified":
+			modified = s.Value == "true"
+		}
+	}
+	if revision == "" {
+		return "dev"
+	}
+	if modified {
+		revision += "-dirty"
+	}
+	return revision
+}
+
+// configHash is a short hash of the running config, so deployments can tell
+// which config every instance runs
+func configHash() string {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// checkDependencies pings MongoDB, checks the search index is READY and the
+// promotion cache is loaded, and times every check
+func checkDependencies(ctx context.Context) []DependencyStatus {
+	check := func(name string, fn func(context.Context) (string, error)) DependencyStatus {
+		ctx, cancel := context.WithTimeout(ctx, HEALTH_CHECK_TIMEOUT)
+		defer cancel()
+		start := time.Now()
+		reason, err := fn(ctx)
+		s := DependencyStatus{Name: name, OK: err == nil, LatencyMs: float64(time.Since(start).Microseconds()) / 1000}
+		if err != nil {
+			if isTimeout(err) {
+				reason = HEALTH_TIMEOUT
+			}
+			s.Reason = reason
+			if sampled("dependency check failed") {
+				log.WithContext(ctx).WithFields(
+					logrus.Fields{
+						"dependency": name,
+						"reason":     reason,
+						"err":        err,
+					}).Warn("dependency check failed")
+			}
+		}
+		return s
+	}
+
+	return []DependencyStatus{
+		check("mongo", func(ctx context.Context) (string, error) {
+			client, err := GetMongoClient(ctx)
+			if err != nil {
+				return HEALTH_UNREACHABLE, err
+			}
+			return HEALTH_UNREACHABLE, client.Ping(ctx, nil)
+		}),
+		check("search index", checkSearchIndex),
+		check("promotion cache", func(ctx context.Context) (string, error) {
+			if !promotionsLoaded() {
+				return HEALTH_NOT_LOADED, errors.New("promotions are not loaded yet")
+			}
+			return "", nil
+		}),
+	}
+}
+
+// indexHealth is the latest search index check, reused for
+// HEALTH_INDEX_CACHE
+var indexHealth struct {
+	sync.Mutex
+	checked time.Time
+	reason  string
+	err     error
+}
+
+// checkSearchIndex checks the search index exists and is READY, or answers
+// the latest check when it's recent. The concurrent probes wait for the one
+// running check
+func checkSearchIndex(ctx context.Context) (string, error) {
+	indexHealth.Lock()
+	defer indexHealth.Unlock()
+	if time.Since(indexHealth.checked) < HEALTH_INDEX_CACHE {
+		return indexHealth.reason, indexHealth.err
+	}
+	reason, err := searchIndexReady(ctx)
+	// A probe which went away didn't check anything
+	if !errors.Is(err, context.Canceled) {
+		indexHealth.checked, indexHealth.reason, indexHealth.err = time.Now(), reason, err
+	}
+	return reason, err
+}
+
+func searchIndexReady(ctx context.Context) (string, error) {
+	client, err := GetMongoClient(ctx)
+	if err != nil {
+		return HEALTH_UNREACHABLE, err
+	}
+	live, err := getLiveIndex(ctx, client.Database(DB).Collection(COLLECTION), SEARCH_INDEX)
+	if err != nil {
+		return HEALTH_UNREACHABLE, err
+	}
+	if live == nil {
+		return HEALTH_INDEX_MISSING, fmt.Errorf("search index %s is missing", SEARCH_INDEX)
+	}
+	if live.Status != "READY" || !live.Queryable {
+		return HEALTH_INDEX_NOT_READY, fmt.Errorf("search index %s is %s, queryable %t", SEARCH_INDEX, live.Status, live.Queryable)
+	}
+	return "", nil
+}
+
+func allOK(deps []DependencyStatus) bool {
+	for _, d := range deps {
+		if !d.OK {
+			return false
+		}
+	}
+	return true
+}
+
+// healthzHandler answers 200 while the process is alive
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("ok\n"))
+}
+
+// readyzHandler answers 200 when the dependencies are ready to serve the
+// searches, and 503 with the reasons of the failed checks otherwise
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	deps := checkDependencies(r.Context())
+	if allOK(deps) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("ok\n"))
+		return
+	}
+
+	// Convert the data to JSON
+	jsonData, err := json.Marshal(deps)
+	if err != nil {
+		http.Error(w, "Error converting data", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write(jsonData)
+}
+
+// statusHandler reports the build version, the config hash, the uptime and
+// every dependency's state and latency
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	deps := checkDependencies(r.Context())
+	status := Status{
+		Version:       buildVersion(),
+		ConfigHash:    configHash(),
+		StartedAt:     startedAt,
+		UptimeSeconds: time.Since(startedAt).Seconds(),
+		Ready:         allOK(deps),
+		Dependencies:  deps,
+	}
+
+	// Convert the data to JSON
+	jsonData, err := json.Marshal(status)
+	if err != nil {
+		http.Error(w, "Error converting data", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonData)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// searchHistoryHandler lists the user's recent search queries with GET,
+// and clears them with DELETE
+func searchHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	v := &validator{}
+	user := v.user(r)
+	if v.reject(w) || !authorizeUser(w, r, user) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		limit := v.intParam(r, "limit", 10, 1, MAX_SEARCH_HISTORY)
+		if v.reject(w) {
+			return
+		}
+		history, err := getSearchHistory(r.Context(), user, limit)
+		if err != nil {
+			dbFailed(w, r, "Error getting search history", err)
+			return
+		}
+
+		// Convert the data to JSON
+		jsonData, err := json.Marshal(history)
+		if err != nil {
+			http.Error(w, "Error converting data", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jsonData)
+	case http.MethodDelete:
+		if err := clearSearchHistory(r.Context(), user); err != nil {
+			dbFailed(w, r, "Error clearing search history", err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// getSearchHistory gets the user's latest distinct search queries, newest
+// first, with how many times each is in the history
+func getSearchHistory(ctx context.Context, user string, limit int) ([]QueryReport, error) {
+	client, err := GetMongoClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := withDeadline(ctx, config.Timeouts.ReportMs)
+	defer cancel()
+	collection := client.Database(DB).Collection(SEARCH_REPORT_COLLECTION)
+
+	var doc SearchHistory
+	err = collection.FindOne(ctx, historyFilter(user)).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		return []QueryReport{}, nil
+	}
+	if err != nil {
+		log.WithContext(ctx).WithFields(
+			logrus.Fields{
+				"user": user,
+				"err":  err,
+			}).Error("get user search history failed")
+		return nil, err
+	}
+
+	history := []QueryReport{}
+	seen := map[string]int{}
+	for i := len(doc.Searches) - 1; i >= 0; i-- {
+		s := doc.Searches[i]
+		if j, ok := seen[s.Query]; ok {
+			history[j].Count++
+			continue
+		}
+		seen[s.Query] = len(history)
+		history = append(history, QueryReport{User: user, Query: s.Query, SearchTime: s.SearchTime, Count: 1})
+	}
+	if len(history) > limit {
+		history = history[:limit]
+	}
+	return history, nil
+}
+
+// historyFilter matches the user's history document, the per-query
+// documents of the earlier versions are left out
+func historyFilter(user string) bson.M {
+	return bson.M{"name": user, "searches": bson.M{"$exists": true}}
+}
+
+// clearSearchHistory removes all the recorded queries of the user
+func clearSearchHistory(ctx context.Context, user string) error {
+	client, err := GetMongoClient(ctx)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := withDeadline(ctx, config.Timeouts.ReportMs)
+	defer cancel()
+	collection := client.Database(DB).Collection(SEARCH_REPORT_COLLECTION)
+
+	res, err := collection.DeleteMany(ctx, bson.M{"name": user})
+	if err != nil {
+		log.WithContext(ctx).WithFields(
+			logrus.Fields{
+				"user": user,
+				"err":  err,
+			}).Error("clear user search history failed")
+		return err
+	}
+	log.WithContext(ctx).WithFields(
+		logrus.Fields{
+			"user":    user,
+			"deleted": res.DeletedCount,
+		}).Info("user search history cleared")
+	return nil
+}
+
+// The searches waiting for the history writer, so the search requests never
+// wait for the history writes
+var historyBuffer = make(chan historyWrite, HISTORY_BUFFER_SIZE)
+
+type historyWrite struct {
+	user   string
+	search SearchedQuery
+}
+
+// recordHistory buffers the user's search, it's dropped when the buffer is
+// full
+func recordHistory(user, query string) {
+	select {
+	case historyBuffer <- historyWrite{user: user, search: SearchedQuery{Query: query, SearchTime: time.Now()}}:
+	default:
+		if sampled("search history buffer is full") {
+			log.WithFields(
+				logrus.Fields{
+					"query": query,
+				}).Warn("search history buffer is full, search dropped")
+		}
+	}
+}
+
+// runHistoryWriter writes the buffered searches until the context is done,
+// and writes the rest of the buffer before returning
+func runHistoryWriter(ctx context.Context) {
+	for {
+		select {
+		case h := <-historyBuffer:
+			writeHistory(h)
+		case <-ctx.Done():
+			for {
+				select {
+				case h := <-historyBuffer:
+					writeHistory(h)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// writeHistory appends the search to the user's history, which keeps the
+// latest MAX_SEARCH_HISTORY searches (FIFO), the document is created on the
+// user's first search
+func writeHistory(h historyWrite) {
+	ctx, cancel := withDeadline(context.Background(), config.Timeouts.ReportMs)
+	defer cancel()
+	client, err := GetMongoClient(ctx)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	collection := client.Database(DB).Collection(SEARCH_REPORT_COLLECTION)
+
+	update := bson.M{"$push": bson.M{"searches": bson.M{"$each": bson.A{h.search}, "$slice": -MAX_SEARCH_HISTORY}}}
+	if _, err := collection.UpdateOne(ctx, historyFilter(h.user), update, options.Update().SetUpsert(true)); err != nil {
+		log.WithFields(
+			logrus.Fields{
+				"query": h.search.Query,
+				"err":   err,
+			}).Error("save user search history failed")
+	}
+}
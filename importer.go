@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ImportRow is one row of the import file with its line number
+type ImportRow struct {
+	Line int
+	Doc  bson.M
+	Err  error
+}
+
+// ImportReject is one rejected row with the reasons
+type ImportReject struct {
+	Line    int
+	Reasons []string
+}
+
+// ImportStats sums up one import
+type ImportStats struct {
+	Rows     int
+	Rejected int
+	Upserted int64
+	Modified int64
+	Matched  int64
+}
+
+// The item fields stored as numbers
+var numericItemFields = map[string]bool{"price": true, "originalPrice": true, "ratio": true}
+
+// importCommand streams the items of a CSV or JSONL file, validates them
+// and upserts them by documentId in batches
+func importCommand(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	path := fs.String("file", "", "CSV or JSONL items file")
+	format := fs.String("format", "", "csv or jsonl, empty guesses from the file extension")
+	batch := fs.Int("batch", 500, "number of items upserted per bulk write")
+	dryRun := fs.Bool("dry-run", false, "only validate the file")
+	fs.Parse(args)
+
+	if *path == "" {
+		return fmt.Errorf("the -file is required")
+	}
+	if *format == "" {
+		*format = strings.TrimPrefix(strings.ToLower(filepath.Ext(*path)), ".")
+	}
+	file, err := os.Open(*path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	rows := make(chan ImportRow, *batch)
+	go func() {
+		defer close(rows)
+		switch *format {
+		case "csv":
+			readCSVItems(file, rows)
+		case "jsonl", "json":
+			readJSONLItems(file, rows)
+		default:
+			rows <- ImportRow{Err: fmt.Errorf("unknown format %q, use csv or jsonl", *format)}
+		}
+	}()
+
+	var collection *mongo.Collection
+	if !*dryRun {
+		client, err := GetMongoClient(context.Background())
+		if err != nil {
+			return err
+		}
+		collection = client.Database(DB).Collection(COLLECTION)
+	}
+
+	stats, rejects, err := importItems(context.Background(), collection, rows, *batch)
+	for _, r := range rejects {
+		fmt.Fprintf(os.Stderr, "line %d rejected: %s\n", r.Line, strings.Join(r.Reasons, "; "))
+	}
+	fmt.Printf("%d rows, %d rejected, %d upserted, %d matched, %d modified\n",
+		stats.Rows, stats.Rejected, stats.Upserted, stats.Matched, stats.Modified)
+	return err
+}
+
+// importItems validates the rows and upserts the valid ones in batches, a
+// nil collection only validates
+func importItems(ctx context.Context, collection *mongo.Collection, rows <-chan ImportRow, batchSize int) (ImportStats, []ImportReject, error) {
+	var stats ImportStats
+	var rejects []ImportReject
+	var models []mongo.WriteModel
+	// Drain the rows on an early return so the reader doesn't block
+	defer func() {
+		for range rows {
+		}
+	}()
+
+	flush := func() error {
+		if len(models) == 0 || collection == nil {
+			models = models[:0]
+			return nil
+		}
+		res, err := collection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+		if res != nil {
+			stats.Upserted += res.UpsertedCount
+			stats.Matched += res.MatchedCount
+			stats.Modified += res.ModifiedCount
+		}
+		models = models[:0]
+		return err
+	}
+
+	for row := range rows {
+		if row.Line == 0 && row.Err != nil {
+			return stats, rejects, row.Err
+		}
+		stats.Rows++
+		var reasons []string
+		var doc bson.M
+		if row.Err != nil {
+			reasons = []string{row.Err.Error()}
+		} else {
+			doc, reasons = validateItemDoc(row.Doc)
+		}
+		if len(reasons) != 0 {
+			stats.Rejected++
+			rejects = append(rejects, ImportReject{Line: row.Line, Reasons: reasons})
+			continue
+		}
+
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"documentId": doc["documentId"]}).
+			SetUpdate(bson.M{"$set": doc}).
+			SetUpsert(true))
+		if len(models) >= batchSize {
+			if err := flush(); err != nil {
+				return stats, rejects, err
+			}
+		}
+	}
+	return stats, rejects, flush()
+}
+
+// validateItemDoc checks the item with Item.Validate, and computes ratio
+// from originalPrice and price. It returns the reasons when the item is
+// invalid
+func validateItemDoc(doc bson.M) (bson.M, []string) {
+	var reasons []string
+	price, ok := numberValue(doc["price"])
+	switch {
+	case doc["price"] == nil:
+		reasons = append(reasons, "price is required")
+	case !ok:
+		reasons = append(reasons, fmt.Sprintf("price %v is not a number", doc["price"]))
+	}
+
+	originalPrice := price
+	if doc["originalPrice"] != nil {
+		if originalPrice, ok = numberValue(doc["originalPrice"]); !ok {
+			reasons = append(reasons, fmt.Sprintf("originalPrice %v is not a number", doc["originalPrice"]))
+		}
+	}
+
+	out := bson.M{}
+	for k, v := range doc {
+		if k != "_id" {
+			out[k] = v
+		}
+	}
+	out["price"] = price
+	out["originalPrice"] = originalPrice
+	out["ratio"] = 1.0
+	if originalPrice > 0 {
+		out["ratio"] = price / originalPrice
+	}
+
+	var item Item
+	data, err := bson.Marshal(out)
+	if err == nil {
+		err = bson.Unmarshal(data, &item)
+	}
+	if err != nil {
+		return nil, append(reasons, err.Error())
+	}
+	if reasons = append(reasons, item.Validate()...); len(reasons) != 0 {
+		return nil, reasons
+	}
+	return out, nil
+}
+
+func numberValue(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(n), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// readCSVItems streams the CSV rows as items, the header row names the fields
+func readCSVItems(r io.Reader, rows chan<- ImportRow) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		rows <- ImportRow{Err: fmt.Errorf("read CSV header: %w", err)}
+		return
+	}
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			rows <- ImportRow{Line: line, Err: err}
+			continue
+		}
+		if len(record) != len(header) {
+			rows <- ImportRow{Line: line, Err: fmt.Errorf("%d columns, the header has %d", len(record), len(header))}
+			continue
+		}
+		doc := bson.M{}
+		for i, field := range header {
+			value := strings.TrimSpace(record[i])
+			if value == "" {
+				continue
+			}
+			if numericItemFields[field] {
+				if f, err := strconv.ParseFloat(value, 64); err == nil {
+					doc[field] = f
+					continue
+				}
+			}
+			doc[field] = value
+		}
+		rows <- ImportRow{Line: line, Doc: doc}
+	}
+}
+
+// readJSONLItems streams the JSONL lines as items, in plain or extended JSON
+func readJSONLItems(r io.Reader, rows chan<- ImportRow) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		var doc bson.M
+		if err := bson.UnmarshalExtJSON([]byte(text), false, &doc); err != nil {
+			rows <- ImportRow{Line: line, Err: err}
+			continue
+		}
+		rows <- ImportRow{Line: line, Doc: doc}
+	}
+	if err := scanner.Err(); err != nil {
+		rows <- ImportRow{Err: err}
+	}
+}
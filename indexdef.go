@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The search index definitions versioned in the repo
+//
+//go:embed indexes/*.json
+var indexFiles embed.FS
+
+// IndexDefinition is one Atlas search index definition file, the version
+// is bumped with every change of the definition
+type IndexDefinition struct {
+	Name       string                 `json:"name"`
+	Collection string                 `json:"collection"`
+	Version    int                    `json:"version"`
+	Definition map[string]interface{} `json:"definition"`
+}
+
+// LiveIndex is one search index of listSearchIndexes
+type LiveIndex struct {
+	ID               string `bson:"id"`
+	Name             string `bson:"name"`
+	Status           string `bson:"status"`
+	Queryable        bool   `bson:"queryable"`
+	LatestDefinition bson.M `bson:"latestDefinition"`
+}
+
+// loadIndexDefinitions loads the definition files of the directory, an
+// empty directory loads the embedded ones
+func loadIndexDefinitions(dir string) ([]IndexDefinition, error) {
+	var files fs.FS = indexFiles
+	root := "indexes"
+	if dir != "" {
+		files, root = os.DirFS(dir), "."
+	}
+	names, err := fs.Glob(files, path.Join(root, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	var defs []IndexDefinition
+	for _, name := range names {
+		data, err := fs.ReadFile(files, name)
+		if err != nil {
+			return nil, err
+		}
+		var def IndexDefinition
+		if err := json.Unmarshal(data, &def); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		if def.Name == "" || def.Collection == "" || def.Definition == nil {
+			return nil, fmt.Errorf("%s: name, collection and definition are required", name)
+		}
+		defs = append(defs, def)
+	}
+	return defs, nil
+}
+
+// getLiveIndex gets the search index from the cluster, nil if it's missing
+func getLiveIndex(ctx context.Context, collection *mongo.Collection, name string) (*LiveIndex, error) {
+	cursor, err := collection.SearchIndexes().List(ctx, options.SearchIndexes().SetName(name))
+	if err != nil {
+		return nil, err
+	}
+	var indexes []LiveIndex
+	if err = cursor.All(ctx, &indexes); err != nil {
+		return nil, err
+	}
+	if len(indexes) == 0 {
+		return nil, nil
+	}
+	return &indexes[0], nil
+}
+
+// diffIndex lists the differences of the live definition to the one in the
+// repo, one line per changed path
+func diffIndex(def IndexDefinition, live *LiveIndex) ([]string, error) {
+	// Round trip the live definition through JSON so both sides have the
+	// same types
+	data, err := bson.MarshalExtJSON(live.LatestDefinition, false, false)
+	if err != nil {
+		return nil, err
+	}
+	var liveDef map[string]interface{}
+	if err := json.Unmarshal(data, &liveDef); err != nil {
+		return nil, err
+	}
+	var lines []string
+	diffValues("", liveDef, def.Definition, &lines)
+	return lines, nil
+}
+
+func diffValues(path string, live, want interface{}, lines *[]string) {
+	liveMap, liveIsMap := live.(map[string]interface{})
+	wantMap, wantIsMap := want.(map[string]interface{})
+	if liveIsMap && wantIsMap {
+		keys := map[string]bool{}
+		for k := range liveMap {
+			keys[k] = true
+		}
+		for k := range wantMap {
+			keys[k] = true
+		}
+		var sorted []string
+		for k := range keys {
+			sorted = append(sorted, k)
+		}
+		sort.Strings(sorted)
+		for _, k := range sorted {
+			diffValues(strings.TrimPrefix(path+"."+k, "."), liveMap[k], wantMap[k], lines)
+		}
+		return
+	}
+	if reflect.DeepEqual(live, want) {
+		return
+	}
+	switch {
+	case live == nil:
+		*lines = append(*lines, fmt.Sprintf("+ %s: %s", path, compactJSON(want)))
+	case want == nil:
+		*lines = append(*lines, fmt.Sprintf("- %s: %s", path, compactJSON(live)))
+	default:
+		*lines = append(*lines, fmt.Sprintf("~ %s: %s -> %s", path, compactJSON(live), compactJSON(want)))
+	}
+}
+
+func compactJSON(v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(data)
+}
+
+// waitIndexReady polls the search index until it has the definition of
+// the repo, and it's READY and queryable
+func waitIndexReady(ctx context.Context, collection *mongo.Collection, def IndexDefinition) error {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		live, err := getLiveIndex(ctx, collection, def.Name)
+		if err != nil {
+			return err
+		}
+		if live != nil {
+			if live.Status == "FAILED" {
+				return fmt.Errorf("search index %s build failed", def.Name)
+			}
+			lines, err := diffIndex(def, live)
+			if err != nil {
+				return err
+			}
+			if len(lines) == 0 && live.Status == "READY" && live.Queryable {
+				return nil
+			}
+			fmt.Printf("%s: %s, waiting\n", def.Name, live.Status)
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("search index %s is not ready: %w", def.Name, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// indexCommand shows the differences of the search index definitions in
+// the repo to the live ones with diff, and creates or updates them with apply
+func indexCommand(args []string) error {
+	if len(args) == 0 || (args[0] != "diff" && args[0] != "apply") {
+		return fmt.Errorf("usage: index diff|apply [-dir dir] [-name name] [-wait duration]")
+	}
+	action := args[0]
+	fs := flag.NewFlagSet("index "+action, flag.ExitOnError)
+	dir := fs.String("dir", "", "directory of the definition files, empty uses the ones built in")
+	name := fs.String("name", "", "only this index, empty is all of them")
+	wait := fs.Duration("wait", 10*time.Minute, "how long apply waits for the indexes to be queryable")
+	fs.Parse(args[1:])
+
+	defs, err := loadIndexDefinitions(*dir)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	client, err := GetMongoClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	var applied []IndexDefinition
+	for _, def := range defs {
+		if *name != "" && def.Name != *name {
+			continue
+		}
+		collection := client.Database(DB).Collection(def.Collection)
+		live, err := getLiveIndex(ctx, collection, def.Name)
+		if err != nil {
+			return fmt.Errorf("%s: %w", def.Name, err)
+		}
+
+		if live == nil {
+			fmt.Printf("%s (v%d): missing on %s\n", def.Name, def.Version, def.Collection)
+			if action == "apply" {
+				model := mongo.SearchIndexModel{Definition: def.Definition, Options: options.SearchIndexes().SetName(def.Name)}
+				if _, err := collection.SearchIndexes().CreateOne(ctx, model); err != nil {
+					return fmt.Errorf("%s: create: %w", def.Name, err)
+				}
+				fmt.Printf("%s: created\n", def.Name)
+				applied = append(applied, def)
+			}
+			continue
+		}
+
+		lines, err := diffIndex(def, live)
+		if err != nil {
+			return fmt.Errorf("%s: %w", def.Name, err)
+		}
+		if len(lines) == 0 {
+			fmt.Printf("%s (v%d): up to date, %s\n", def.Name, def.Version, live.Status)
+			continue
+		}
+		fmt.Printf("%s (v%d): %d differences, %s\n", def.Name, def.Version, len(lines), live.Status)
+		for _, line := range lines {
+			fmt.Println("  " + line)
+		}
+		if action == "apply" {
+			if err := collection.SearchIndexes().UpdateOne(ctx, def.Name, def.Definition); err != nil {
+				return fmt.Errorf("%s: update: %w", def.Name, err)
+			}
+			fmt.Printf("%s: updated\n", def.Name)
+			applied = append(applied, def)
+		}
+	}
+
+	if len(applied) == 0 {
+		return nil
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, *wait)
+	defer cancel()
+	for _, def := range applied {
+		if err := waitIndexReady(waitCtx, client.Database(DB).Collection(def.Collection), def); err != nil {
+			return err
+		}
+		fmt.Printf("%s: ready\n", def.Name)
+	}
+	return nil
+}
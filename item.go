@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+// Item is one eShop item of the items collection, and the JSON schema of
+// the items in every handler's response. All the fields are always present
+type Item struct {
+	DocumentId    string  `json:"documentId" bson:"documentId"`
+	Name          string  `json:"name" bson:"name"`
+	Name2         string  `json:"name2" bson:"name2"`
+	Price         float64 `json:"price" bson:"price"`
+	OriginalPrice float64 `json:"originalPrice" bson:"originalPrice"`
+	Ratio         float64 `json:"ratio" bson:"ratio"`
+	ProductTag    Tags    `json:"productTag" bson:"productTag"`
+	DiscountTag   Tags    `json:"discountTag" bson:"discountTag"`
+	ImageUrl      string  `json:"imageUrl" bson:"imageUrl"`
+	ImageUrl2     string  `json:"imageUrl2" bson:"imageUrl2"`
+}
+
+// SearchHit is one item of the search results, with the optional search
+// details of the search mode
+type SearchHit struct {
+	Item `bson:",inline"`
+
+	// Score is the Atlas search score, only in blended and debug results
+	Score float64 `json:"score,omitempty" bson:"score,omitempty"`
+	// Source is organic, personalized or both in blended results
+	Source string `json:"source,omitempty" bson:"source,omitempty"`
+	// BlendScore is the score fusion or reciprocal rank fusion score
+	BlendScore float64 `json:"blendScore,omitempty" bson:"blendScore,omitempty"`
+	// ScoreDetails are the Atlas score details in debug results
+	ScoreDetails bson.M `json:"scoreDetails,omitempty" bson:"scoreDetails,omitempty"`
+	// ProfileTagMatches are the matched profile tags by field in debug results
+	ProfileTagMatches map[string][]string `json:"profileTagMatches,omitempty" bson:"profileTagMatches,omitempty"`
+}
+
+// The item fields projected by all the pipelines
+var itemFields = []string{
+	"documentId", "name", "name2",
+	"price", "originalPrice", "ratio",
+	"productTag", "discountTag",
+	"imageUrl", "imageUrl2",
+}
+
+// itemProjection is the $project stage document of the item fields
+func itemProjection() bson.D {
+	projection := bson.D{{"_id", 0}}
+	for _, f := range itemFields {
+		projection = append(projection, bson.E{f, 1})
+	}
+	return projection
+}
+
+// Validate lists the problems of the item, none when it's valid
+func (i *Item) Validate() []string {
+	var reasons []string
+	if strings.TrimSpace(i.DocumentId) == "" {
+		reasons = append(reasons, "documentId is required")
+	}
+	if strings.TrimSpace(i.Name) == "" {
+		reasons = append(reasons, "name is required")
+	}
+	if strings.TrimSpace(i.Name2) == "" {
+		reasons = append(reasons, "name2 is required")
+	}
+	if i.Price < 0 {
+		reasons = append(reasons, "price is negative")
+	}
+	if i.OriginalPrice < 0 {
+		reasons = append(reasons, "originalPrice is negative")
+	}
+	return reasons
+}
+
+// Tags are the productTag or discountTag values, stored either as one
+// string or as an array of strings
+type Tags []string
+
+// UnmarshalBSONValue decodes a string, an array of strings or null
+func (t *Tags) UnmarshalBSONValue(typ bsontype.Type, data []byte) error {
+	switch typ {
+	case bsontype.Null, bsontype.Undefined:
+		*t = nil
+		return nil
+	case bsontype.String:
+		var s string
+		if err := bson.UnmarshalValue(typ, data, &s); err != nil {
+			return err
+		}
+		*t = Tags{s}
+		return nil
+	case bsontype.Array:
+		var values []string
+		if err := bson.UnmarshalValue(typ, data, &values); err != nil {
+			return err
+		}
+		*t = values
+		return nil
+	}
+	return fmt.Errorf("cannot decode %s into tags", typ)
+}
+
+// MarshalJSON writes no tags as an empty array instead of null
+func (t Tags) MarshalJSON() ([]byte, error) {
+	if t == nil {
+		return []byte("[]"), nil
+	}
+	return json.Marshal([]string(t))
+}
+
+// toResults decodes the pipeline documents into the typed search hits, the
+// malformed items are logged and left out
+func toResults(docs []bson.M) Results {
+	results := Results{}
+	for _, doc := range docs {
+		var hit SearchHit
+		data, err := bson.Marshal(doc)
+		if err == nil {
+			err = bson.Unmarshal(data, &hit)
+		}
+		if err != nil {
+			log.WithFields(
+				logrus.Fields{
+					"documentId": doc["documentId"],
+					"err":        err,
+				}).Error("decode item failed")
+			continue
+		}
+		results = append(results, hit)
+	}
+	return results
+}
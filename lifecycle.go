@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MongoDB reconnect backoff
+const (
+	MONGO_CONNECT_TIMEOUT = 10 * time.Second
+	MONGO_BACKOFF_MIN     = time.Second
+	MONGO_BACKOFF_MAX     = 30 * time.Second
+)
+
+// The background workers, the shutdown waits for them before disconnecting
+var workers sync.WaitGroup
+
+// startWorker runs the background job until the context is done
+func startWorker(ctx context.Context, run func(context.Context)) {
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		run(ctx)
+	}()
+}
+
+// connectMongo connects and pings the cluster, the client is disconnected
+// when the ping fails
+func connectMongo() (*mongo.Client, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), MONGO_CONNECT_TIMEOUT)
+	defer cancel()
+	clientOptions := options.Client().ApplyURI(CONNECTIONSTRING).SetMonitor(mongoMonitor())
+	client, err := mongo.Connect(ctx, clientOptions)
+	if err != nil {
+		return nil, err
+	}
+	// Check the connection
+	if err = client.Ping(ctx, nil); err != nil {
+		client.Disconnect(context.Background())
+		return nil, err
+	}
+	return client, nil
+}
+
+// waitForMongo retries connecting with backoff until it succeeds or the
+// context is done, so a short outage at startup doesn't fail the checks
+func waitForMongo(ctx context.Context) error {
+	for {
+		_, err := GetMongoClient(ctx)
+		if err == nil {
+			return nil
+		}
+		mongoMu.Lock()
+		wait := time.Until(mongoRetryAt)
+		mongoMu.Unlock()
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+	}
+}
+
+// disconnectMongo closes the client, the next GetMongoClient reconnects
+func disconnectMongo(ctx context.Context) error {
+	mongoMu.Lock()
+	client := clientInstance
+	clientInstance = nil
+	mongoMu.Unlock()
+	if client == nil {
+		return nil
+	}
+	return client.Disconnect(ctx)
+}
+
+// serve serves until the context is done, then drains the in-flight
+// requests, stops the background workers so they flush the analytics
+// buffer, and disconnects from MongoDB
+func serve(ctx context.Context, server *http.Server, stopWorkers context.CancelFunc) error {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errs:
+		stopWorkers()
+		return err
+	case <-ctx.Done():
+	}
+	log.Info("shutting down, draining the in-flight requests")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(config.Server.ShutdownSeconds)*time.Second)
+	defer cancel()
+	err := server.Shutdown(shutdownCtx)
+	if err != nil {
+		log.WithFields(
+			logrus.Fields{
+				"err": err,
+			}).Error("drain the in-flight requests failed")
+	}
+
+	// The handlers are done, so no more events are recorded
+	stopWorkers()
+	done := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-shutdownCtx.Done():
+		log.Error("background workers didn't stop in time")
+	}
+
+	if dErr := disconnectMongo(shutdownCtx); dErr != nil {
+		log.WithFields(
+			logrus.Fields{
+				"err": dErr,
+			}).Error("disconnect from MongoDB failed")
+	}
+	log.Info("shut down")
+	return err
+}
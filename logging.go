@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Log sinks and formats
+const (
+	LOG_STDOUT = "stdout"
+	LOG_FILE   = "file"
+	LOG_JSON   = "json"
+	LOG_TEXT   = "text"
+)
+
+// REQUEST_ID_HEADER carries the request ID from the caller, and back in
+// the response
+const REQUEST_ID_HEADER = "X-Request-ID"
+
+// setupLogging creates the logger of the configured level, format and
+// sinks, and returns the function closing the log file
+func setupLogging() (func() error, error) {
+	c := config.Logging
+	logger := logrus.New()
+
+	level, err := logrus.ParseLevel(c.Level)
+	if err != nil {
+		return nil, err
+	}
+	logger.SetLevel(level)
+
+	switch c.Format {
+	case LOG_JSON:
+		logger.SetFormatter(&logrus.JSONFormatter{})
+	case LOG_TEXT:
+		logger.SetFormatter(&logrus.TextFormatter{DisableColors: true, FullTimestamp: true})
+	default:
+		return nil, fmt.Errorf("unknown log format %q, use json or text", c.Format)
+	}
+
+	var writers []io.Writer
+	var file *lumberjack.Logger
+	for _, sink := range c.Sinks {
+		switch sink {
+		case LOG_STDOUT:
+			writers = append(writers, os.Stdout)
+		case LOG_FILE:
+			// lumberjack creates the files readable by the owner only
+			file = &lumberjack.Logger{
+				Filename:   c.File.Path,
+				MaxSize:    c.File.MaxSizeMB,
+				MaxBackups: c.File.MaxBackups,
+				MaxAge:     c.File.MaxAgeDays,
+				Compress:   c.File.Compress,
+			}
+			writers = append(writers, file)
+		default:
+			return nil, fmt.Errorf("unknown log sink %q, use stdout or file", sink)
+		}
+	}
+	logger.SetOutput(io.MultiWriter(writers...))
+
+	logger.AddHook(contextHook{})
+	logger.AddHook(newRedactHook(c.RedactFields))
+	log = logger
+	if file == nil {
+		return func() error { return nil }, nil
+	}
+	return file.Close, nil
+}
+
+// contextHook adds the request ID and the trace ID of the entry's context,
+// set with log.WithContext(ctx)
+type contextHook struct{}
+
+func (contextHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (contextHook) Fire(e *logrus.Entry) error {
+	if e.Context == nil {
+		return nil
+	}
+	if id := requestIDFrom(e.Context); id != "" {
+		e.Data["request_id"] = id
+	}
+	if sc := trace.SpanContextFromContext(e.Context); sc.HasTraceID() {
+		e.Data["trace_id"] = sc.TraceID().String()
+	}
+	return nil
+}
+
+// redactHook replaces the PII fields with a short hash, so the entries of
+// the same user can still be correlated
+type redactHook struct {
+	fields map[string]bool
+}
+
+func newRedactHook(fields []string) redactHook {
+	h := redactHook{fields: map[string]bool{}}
+	for _, f := range fields {
+		h.fields[f] = true
+	}
+	return h
+}
+
+func (h redactHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h redactHook) Fire(e *logrus.Entry) error {
+	for k, v := range e.Data {
+		if h.fields[k] {
+			e.Data[k] = redact(v)
+		}
+	}
+	return nil
+}
+
+func redact(v interface{}) string {
+	sum := sha256.Sum256([]byte(fmt.Sprint(v)))
+	return "redacted:" + hex.EncodeToString(sum[:4])
+}
+
+// The occurrences of every sampled log
+var logSamples sync.Map
+
+// sampled tells if this occurrence of the noisy log is written: the first
+// one and then one of every SampleEvery
+func sampled(key string) bool {
+	every := uint64(config.Logging.SampleEvery)
+	if every <= 1 {
+		return true
+	}
+	v, _ := logSamples.LoadOrStore(key, new(uint64))
+	n := atomic.AddUint64(v.(*uint64), 1)
+	return n%every == 1
+}
+
+type requestIDKey struct{}
+
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// withRequestID gives every request an ID, the caller's one when it sends a
+// valid one, and echoes it in the response
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(REQUEST_ID_HEADER)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(REQUEST_ID_HEADER, id)
+		trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("request.id", id))
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
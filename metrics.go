@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.mongodb.org/mongo-driver/event"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// METRICS_NAMESPACE prefixes every metric name
+const METRICS_NAMESPACE = "search"
+
+// Error types of the errors counter
+const (
+	ERROR_TIMEOUT  = "timeout"
+	ERROR_CANCELED = "canceled"
+	ERROR_MONGO    = "mongo"
+	ERROR_INTERNAL = "internal"
+)
+
+var (
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by endpoint, search mode and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"endpoint", "mode", "code"})
+
+	aggregateDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "mongo_aggregate_duration_seconds",
+		Help:      "MongoDB aggregate command latency by endpoint and search mode.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"endpoint", "mode", "status"})
+
+	zeroResultSearches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "zero_result_searches_total",
+		Help:      "Searches without any result by search mode.",
+	}, []string{"mode"})
+
+	searchErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "errors_total",
+		Help:      "Failed requests by endpoint and error type.",
+	}, []string{"endpoint", "type"})
+
+	cacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "cache_requests_total",
+		Help:      "Search result cache lookups by result: hit, miss or shared.",
+	}, []string{"result"})
+
+	rateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "rate_limited_requests_total",
+		Help:      "Requests answered 429 by route class: search, click, admin or auth.",
+	}, []string{"class"})
+
+	_ = promauto.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "analytics_dropped_events_total",
+		Help:      "Analytics events dropped on a full buffer or a failed write.",
+	}, func() float64 {
+		return float64(atomic.LoadUint64(&droppedEvents))
+	})
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "active_promotions",
+		Help:      "Promotions active right now.",
+	}, func() float64 {
+		promotions.mu.RLock()
+		defer promotions.mu.RUnlock()
+		return float64(len(promotions.activeIDs))
+	})
+)
+
+// requestLabels are the metric labels of the request, carried by its context
+// down to the MongoDB commands
+type requestLabels struct {
+	Endpoint string
+	Mode     string
+}
+
+type labelsKey struct{}
+
+func labelsFrom(ctx context.Context) *requestLabels {
+	if l, ok := ctx.Value(labelsKey{}).(*requestLabels); ok {
+		return l
+	}
+	return &requestLabels{Endpoint: "none", Mode: "none"}
+}
+
+// withLabels carries the request labels of from into ctx, for the work
+// running detached from the request
+func withLabels(ctx, from context.Context) context.Context {
+	if l, ok := from.Value(labelsKey{}).(*requestLabels); ok {
+		return context.WithValue(ctx, labelsKey{}, l)
+	}
+	return ctx
+}
+
+// setMetricsMode sets the search mode label of the request, for the
+// endpoints whose mode is only known while handling it
+func setMetricsMode(ctx context.Context, mode string) {
+	if l, ok := ctx.Value(labelsKey{}).(*requestLabels); ok {
+		l.Mode = mode
+	}
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// instrument times the requests of the endpoint, and labels their context
+// with the endpoint and the search mode
+func instrument(endpoint, mode string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		labels := &requestLabels{Endpoint: endpoint, Mode: mode}
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		next(rec, r.WithContext(context.WithValue(r.Context(), labelsKey{}, labels)))
+		requestDuration.WithLabelValues(labels.Endpoint, labels.Mode, strconv.Itoa(rec.status)).
+			Observe(time.Since(start).Seconds())
+	}
+}
+
+// countError counts the failed request by error type
+func countError(ctx context.Context, err error) {
+	typ := ERROR_INTERNAL
+	var cmdErr mongo.CommandError
+	switch {
+	case isTimeout(err):
+		typ = ERROR_TIMEOUT
+	case errors.Is(err, context.Canceled):
+		typ = ERROR_CANCELED
+	case errors.As(err, &cmdErr), mongo.IsNetworkError(err):
+		typ = ERROR_MONGO
+	}
+	searchErrors.WithLabelValues(labelsFrom(ctx).Endpoint, typ).Inc()
+}
+
+// commandMonitor times the aggregate commands with the labels of the
+// request context
+func commandMonitor() *event.CommandMonitor {
+	observe := func(ctx context.Context, name string, d time.Duration, status string) {
+		if name != "aggregate" {
+			return
+		}
+		l := labelsFrom(ctx)
+		aggregateDuration.WithLabelValues(l.Endpoint, l.Mode, status).Observe(d.Seconds())
+	}
+	return &event.CommandMonitor{
+		Succeeded: func(ctx context.Context, e *event.CommandSucceededEvent) {
+			observe(ctx, e.CommandName, e.Duration, "ok")
+		},
+		Failed: func(ctx context.Context, e *event.CommandFailedEvent) {
+			observe(ctx, e.CommandName, e.Duration, "failed")
+		},
+	}
+}
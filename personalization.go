@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Customer is the website visitor's profile and recent behavior
+type Customer struct {
+	Name         string       `json:"name" bson:"name"`
+	RegisterDate time.Time    `json:"register_date" bson:"register_date"`
+	Tags         []string     `json:"tags" bson:"tags"`
+	ViewHistory  []ItemReport `json:"viewHistory" bson:"viewHistory"`
+
+	LearnedTags          []LearnedTag `json:"learnedTags" bson:"learnedTags,omitempty"`
+	LearnedTagsScannedAt time.Time    `json:"learnedTagsScannedAt" bson:"learnedTagsScannedAt,omitempty"`
+}
+
+// PersonalizationSignal is one viewed item used as a moreLikeThis clause,
+// weighted by how recently and how often the user viewed it
+type PersonalizationSignal struct {
+	DocumentId string
+	Views      int
+	LastView   time.Time
+	Weight     float64
+	Boost      float64
+	Like       bson.M
+}
+
+// PersonalizationProfile is everything the personalized search knows about
+// the user: the weighted view history and the profile tags
+type PersonalizationProfile struct {
+	Signals []PersonalizationSignal
+	Tags    []string
+}
+
+// getCustomer gets the user's profile document
+func getCustomer(ctx context.Context, user string) (*Customer, error) {
+	client, err := GetMongoClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	collection := client.Database(DB).Collection(CUSTOMER_COLLECTION)
+
+	var c Customer
+	if err := collection.FindOne(ctx, bson.M{"name": user}).Decode(&c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// buildSignals weights every viewed item by recency decay and view count,
+// and keeps the strongest ones. Boosts are scaled so the strongest signal
+// gets the configured moreLikeThis boost
+func buildSignals(views []ItemReport, now time.Time, c PersonalizationConfig) []PersonalizationSignal {
+	byID := map[string]*PersonalizationSignal{}
+	for _, v := range views {
+		if v.DocumentId == "" {
+			continue
+		}
+		s, ok := byID[v.DocumentId]
+		if !ok {
+			s = &PersonalizationSignal{DocumentId: v.DocumentId}
+			byID[v.DocumentId] = s
+		}
+		s.Views++
+		if v.ViewTime.After(s.LastView) {
+			s.LastView = v.ViewTime
+		}
+	}
+
+	signals := make([]PersonalizationSignal, 0, len(byID))
+	for _, s := range byID {
+		age := now.Sub(s.LastView).Hours()
+		if age < 0 {
+			age = 0
+		}
+		decay := 1.0
+		if c.HalfLifeHours > 0 {
+			decay = math.Pow(0.5, age/c.HalfLifeHours)
+		}
+		s.Weight = decay * (1 + c.ViewCountWeight*float64(s.Views-1))
+		signals = append(signals, *s)
+	}
+
+	sort.Slice(signals, func(i, j int) bool {
+		if signals[i].Weight == signals[j].Weight {
+			return signals[i].LastView.After(signals[j].LastView)
+		}
+		return signals[i].Weight > signals[j].Weight
+	})
+	if c.MaxSignals > 0 && len(signals) > c.MaxSignals {
+		signals = signals[:c.MaxSignals]
+	}
+	if len(signals) == 0 {
+		return signals
+	}
+
+	for i := range signals {
+		boost := c.MoreLikeThisBoost * signals[i].Weight / signals[0].Weight
+		signals[i].Boost = math.Max(boost, c.MinBoost)
+	}
+	return signals
+}
+
+// loadPersonalizationProfile loads the user's profile within the profile
+// deadline. A user without a customer document has no profile
+func loadPersonalizationProfile(ctx context.Context, user string) (profile *PersonalizationProfile, err error) {
+	ctx, cancel := withDeadline(ctx, config.Timeouts.ProfileMs)
+	defer cancel()
+	ctx, span := startSpan(ctx, "personalization.profile")
+	defer func() { endSpan(span, err) }()
+
+	profile, err = getPersonalizationProfile(ctx, user)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	return profile, err
+}
+
+// getPersonalizationProfile builds the user's personalization signals from the
+// view history, and fills in the viewed items' fields as the like documents
+func getPersonalizationProfile(ctx context.Context, user string) (*PersonalizationProfile, error) {
+	c := config.Personalization
+	customer, err := getCustomer(ctx, user)
+	if err != nil {
+		log.WithContext(ctx).WithFields(
+			logrus.Fields{
+				"user": user,
+				"err":  err,
+			}).Error("get customer for personalization failed")
+		return nil, err
+	}
+	profile := &PersonalizationProfile{Tags: customer.Tags}
+	// Fall back to the learned tags for users who never filled in a profile
+	if len(profile.Tags) == 0 {
+		profile.Tags = confidentTags(customer.LearnedTags, config.LearnedTags.MinConfidence)
+	}
+	signals := buildSignals(customer.ViewHistory, time.Now(), c)
+	if len(signals) == 0 {
+		return profile, nil
+	}
+
+	var IDs []string
+	for _, s := range signals {
+		IDs = append(IDs, s.DocumentId)
+	}
+
+	// Create a projection
+	projection := bson.M{"_id": 0, "documentId": 1}
+	for _, f := range c.Fields {
+		projection[f] = 1
+	}
+
+	client, err := GetMongoClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	findOptions := options.Find().SetProjection(projection)
+	collection := client.Database(DB).Collection(COLLECTION)
+	cursor, err := collection.Find(ctx, bson.M{"documentId": bson.M{"$in": IDs}}, findOptions)
+	if err != nil {
+		return nil, err
+	}
+	var items []bson.M
+	if err = cursor.All(ctx, &items); err != nil {
+		return nil, err
+	}
+
+	likes := map[string]bson.M{}
+	for _, item := range items {
+		id, _ := item["documentId"].(string)
+		delete(item, "documentId")
+		likes[id] = item
+	}
+
+	// Drop the signals whose items are no longer in the catalog
+	result := signals[:0]
+	for _, s := range signals {
+		if like, ok := likes[s.DocumentId]; ok && len(like) > 0 {
+			s.Like = like
+			result = append(result, s)
+		}
+	}
+	profile.Signals = result
+	if sampled("built personalization profile") {
+		log.WithContext(ctx).WithFields(
+			logrus.Fields{
+				"user":    user,
+				"signals": len(result),
+				"tags":    len(profile.Tags),
+			}).Debug("built personalization profile")
+	}
+	return profile, nil
+}
+
+// annotateTagMatches adds the profile tags matched by every result's
+// productTag and discountTag, so the debug output shows the tag contribution
+// next to the Atlas score details
+func annotateTagMatches(results []bson.M, tags []string) {
+	wanted := map[string]bool{}
+	for _, t := range tags {
+		wanted[strings.ToLower(t)] = true
+	}
+	for _, item := range results {
+		matches := bson.M{}
+		for _, field := range []string{"productTag", "discountTag"} {
+			var matched []string
+			for _, v := range stringValues(item[field]) {
+				if wanted[strings.ToLower(v)] {
+					matched = append(matched, v)
+				}
+			}
+			if len(matched) != 0 {
+				matches[field] = matched
+			}
+		}
+		item["profileTagMatches"] = matches
+	}
+}
+
+// stringValues flattens a string or an array of strings field
+func stringValues(v interface{}) []string {
+	switch t := v.(type) {
+	case string:
+		return []string{t}
+	case bson.A:
+		var values []string
+		for _, e := range t {
+			if s, ok := e.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	case []string:
+		return t
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Promotion event types
+const (
+	EVENT_PROMOTION_START = "promotion-start"
+	EVENT_PROMOTION_END   = "promotion-end"
+)
+
+// promotionCache keeps the active and upcoming promotions in process, so the
+// marketing search never waits for the marketing_config collection
+type promotionCache struct {
+	mu         sync.RWMutex
+	promotions []PromotionConfig
+	active     *PromotionConfig
+	activeIDs  map[string]bool
+	loaded     bool
+	timers     []*time.Timer
+	refresh    chan struct{}
+}
+
+var promotions = &promotionCache{refresh: make(chan struct{}, 1)}
+
+func init() {
+	// Reload on every marketing_config change
+	onCatalogChange(func(e ChangeEvent) {
+		if e.Collection == MARKETING_CONFIG_COLLECTION {
+			promotions.invalidate()
+		}
+	})
+}
+
+// activePromotion gets the cached active promotion, nil when there is none
+// or the cache isn't loaded yet
+func activePromotion() *PromotionConfig {
+	promotions.mu.RLock()
+	defer promotions.mu.RUnlock()
+	return promotions.active
+}
+
+// promotionsLoaded tells if the promotions were loaded at least once
+func promotionsLoaded() bool {
+	promotions.mu.RLock()
+	defer promotions.mu.RUnlock()
+	return promotions.loaded
+}
+
+// invalidate asks the cache to reload, without waiting for it
+func (c *promotionCache) invalidate() {
+	select {
+	case c.refresh <- struct{}{}:
+	default:
+	}
+}
+
+// runPromotionCache loads the promotions on start, every refresh period and
+// on every change of marketing_config until the context is done
+func runPromotionCache(ctx context.Context) {
+	period := time.Duration(config.Promotion.RefreshSeconds) * time.Second
+	if period <= 0 {
+		period = 5 * time.Minute
+	}
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	defer promotions.stopTimers()
+
+	for {
+		if err := promotions.load(ctx); err != nil {
+			log.WithFields(
+				logrus.Fields{
+					"err": err,
+				}).Error("load promotions failed, keeping the cached ones")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-promotions.refresh:
+		}
+	}
+}
+
+// load reads the active promotions which haven't ended, then schedules the
+// timers of their start and end boundaries
+func (c *promotionCache) load(ctx context.Context) error {
+	client, err := GetMongoClient(ctx)
+	if err != nil {
+		return err
+	}
+	collection := client.Database(DB).Collection(MARKETING_CONFIG_COLLECTION)
+	filter := bson.M{
+		"status":  "active",
+		"endDate": bson.M{"$gte": time.Now()},
+	}
+	cursor, err := collection.Find(ctx, filter, options.Find().SetSort(bson.D{{"startDate", 1}}))
+	if err != nil {
+		return err
+	}
+	var loaded []PromotionConfig
+	if err = cursor.All(ctx, &loaded); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.promotions = loaded
+	c.stopTimersLocked()
+	now := time.Now()
+	for _, p := range loaded {
+		for _, boundary := range []time.Time{p.StartDate, p.EndDate} {
+			if boundary.After(now) {
+				c.timers = append(c.timers, time.AfterFunc(boundary.Sub(now), c.evaluate))
+			}
+		}
+	}
+	c.mu.Unlock()
+
+	log.WithFields(
+		logrus.Fields{
+			"promotions": len(loaded),
+		}).Info("promotions loaded")
+	c.evaluate()
+	return nil
+}
+
+// evaluate picks the active promotion at the current time, the latest
+// started one wins, and records the activated and expired promotions
+func (c *promotionCache) evaluate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	var active *PromotionConfig
+	activeIDs := map[string]bool{}
+	for i := range c.promotions {
+		p := &c.promotions[i]
+		if now.Before(p.StartDate) || !now.Before(p.EndDate) {
+			continue
+		}
+		activeIDs[p.ID.Hex()] = true
+		if active == nil || !p.StartDate.Before(active.StartDate) {
+			active = p
+		}
+	}
+
+	// The promotions active on the first load are the baseline, not
+	// activations
+	if c.loaded {
+		for id := range activeIDs {
+			if !c.activeIDs[id] {
+				recordPromotionEvent(EVENT_PROMOTION_START, id)
+			}
+		}
+		for id := range c.activeIDs {
+			if !activeIDs[id] {
+				recordPromotionEvent(EVENT_PROMOTION_END, id)
+			}
+		}
+	}
+	c.active = active
+	c.activeIDs = activeIDs
+	c.loaded = true
+}
+
+func (c *promotionCache) stopTimers() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stopTimersLocked()
+}
+
+func (c *promotionCache) stopTimersLocked() {
+	for _, t := range c.timers {
+		t.Stop()
+	}
+	c.timers = nil
+}
+
+func recordPromotionEvent(typ string, id string) {
+	log.WithFields(
+		logrus.Fields{
+			"type":      typ,
+			"promotion": id,
+		}).Info("promotion changed")
+	recordEvent(Event{Type: typ, Promotion: id})
+}
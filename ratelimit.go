@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Rate limit Config
+const (
+	RATE_LIMIT_COLLECTION = "rate_limits"
+	RATE_LIMIT_SWEEP      = time.Minute
+)
+
+// Rate limit stores
+const (
+	RATE_STORE_MEMORY = "memory"
+	RATE_STORE_MONGO  = "mongo"
+)
+
+// Rate limited route classes, each has its own budget
+const (
+	RATE_SEARCH = "search"
+	RATE_CLICK  = "click"
+	RATE_ADMIN  = "admin"
+	RATE_PROBE  = "probe"
+	RATE_AUTH   = "auth" // the invalid API keys of an IP
+)
+
+// RateLimiter takes one token of the client's bucket, and tells how long to
+// wait for the next one when the bucket is empty
+type RateLimiter interface {
+	Allow(ctx context.Context, key string, budget RateBudget) (bool, time.Duration, error)
+}
+
+// The rate limiter of the routes, nil doesn't limit
+var limiter RateLimiter
+
+// newRateLimiter creates the limiter of the configured store
+func newRateLimiter() (RateLimiter, error) {
+	c := config.RateLimit
+	if !c.Enabled {
+		return nil, nil
+	}
+	switch c.Store {
+	case RATE_STORE_MEMORY:
+		return newMemoryLimiter(), nil
+	case RATE_STORE_MONGO:
+		return &mongoLimiter{}, nil
+	}
+	return nil, fmt.Errorf("unknown rate limit store %q, use memory or mongo", c.Store)
+}
+
+// rateLimit answers 429 with Retry-After when the client used up the budget
+// of the route class. The limiter failing lets the request through
+func rateLimit(class string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		budget := config.RateLimit.budget(class)
+		if limiter == nil || budget.RatePerSecond <= 0 {
+			next(w, r)
+			return
+		}
+		ok, retryAfter, err := limiter.Allow(r.Context(), class+":"+rateLimitKey(r), budget)
+		if err != nil {
+			if sampled("rate limiter failed") {
+				log.WithContext(r.Context()).WithFields(
+					logrus.Fields{
+						"class": class,
+						"err":   err,
+					}).Warn("rate limiter failed, request let through")
+			}
+		} else if !ok {
+			rateLimited.WithLabelValues(class).Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// rateLimitKey is the client of the request: its verified API key, else its
+// IP. The claimed user names and the unverified keys don't count, or a
+// client could get a new budget with every made up one
+func rateLimitKey(r *http.Request) string {
+	if key := apiKeyFrom(r.Context()); key != nil {
+		return "key:" + key.ID
+	}
+	return "ip:" + clientIP(r)
+}
+
+// clientIP is the request's remote IP, or with trustProxy the first
+// X-Forwarded-For address set by the load balancer
+func clientIP(r *http.Request) string {
+	if config.RateLimit.TrustProxy {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			return strings.TrimSpace(strings.Split(fwd, ",")[0])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// tokenBucket is the client's bucket, it refills at the budget's rate up to
+// its burst
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// take refills the bucket and takes one token, or tells how long until the
+// next token
+func (b *tokenBucket) take(now time.Time, budget RateBudget) (bool, time.Duration) {
+	burst := float64(budget.Burst)
+	if b.updated.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens = math.Min(burst, b.tokens+now.Sub(b.updated).Seconds()*budget.RatePerSecond)
+	}
+	b.updated = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / budget.RatePerSecond * float64(time.Second))
+}
+
+// memoryLimiter keeps the buckets in the process, every instance has its
+// own budget
+type memoryLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+func newMemoryLimiter() *memoryLimiter {
+	return &memoryLimiter{buckets: map[string]*tokenBucket{}, swept: time.Now()}
+}
+
+func (l *memoryLimiter) Allow(ctx context.Context, key string, budget RateBudget) (bool, time.Duration, error) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Drop the buckets idle long enough to be full again
+	if now.Sub(l.swept) > RATE_LIMIT_SWEEP {
+		for k, b := range l.buckets {
+			if now.Sub(b.updated) > RATE_LIMIT_SWEEP {
+				delete(l.buckets, k)
+			}
+		}
+		l.swept = now
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{}
+		l.buckets[key] = b
+	}
+	allowed, retryAfter := b.take(now, budget)
+	return allowed, retryAfter, nil
+}
+
+// wait tells how long until the key's bucket has a token, 0 when it has one
+// now. No token is taken
+func (l *memoryLimiter) wait(key string, budget RateBudget) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[key]
+	if !ok {
+		return 0
+	}
+	tokens := math.Min(float64(budget.Burst), b.tokens+time.Since(b.updated).Seconds()*budget.RatePerSecond)
+	if tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - tokens) / budget.RatePerSecond * float64(time.Second))
+}
+
+// mongoLimiter keeps the buckets in the rate_limits collection, shared by
+// all the instances. A bucket is refilled and taken from in one atomic
+// update, and it expires once it would be full again
+type mongoLimiter struct {
+	indexOnce sync.Once
+}
+
+func (l *mongoLimiter) Allow(ctx context.Context, key string, budget RateBudget) (bool, time.Duration, error) {
+	client, err := GetMongoClient(ctx)
+	if err != nil {
+		return false, 0, err
+	}
+	collection := client.Database(DB).Collection(RATE_LIMIT_COLLECTION)
+	l.indexOnce.Do(func() {
+		model := mongo.IndexModel{
+			Keys:    bson.D{{"expireAt", 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		}
+		if _, err := collection.Indexes().CreateOne(ctx, model); err != nil {
+			log.WithFields(
+				logrus.Fields{
+					"err": err,
+				}).Error("create the rate limit expiry index failed")
+		}
+	})
+
+	now := time.Now()
+	burst := float64(budget.Burst)
+	refill := time.Duration(burst / budget.RatePerSecond * float64(time.Second))
+	elapsed := bson.D{{"$divide", bson.A{bson.D{{"$subtract", bson.A{now, bson.D{{"$ifNull", bson.A{"$updated", now}}}}}}, 1000}}}
+	update := mongo.Pipeline{
+		{{"$set", bson.D{
+			{"tokens", bson.D{{"$min", bson.A{burst, bson.D{{"$add", bson.A{
+				bson.D{{"$ifNull", bson.A{"$tokens", burst}}},
+				bson.D{{"$multiply", bson.A{elapsed, budget.RatePerSecond}}},
+			}}}}}}},
+			{"updated", now},
+			{"expireAt", now.Add(refill)},
+		}}},
+		{{"$set", bson.D{{"allowed", bson.D{{"$gte", bson.A{"$tokens", 1}}}}}}},
+		{{"$set", bson.D{{"tokens", bson.D{{"$cond", bson.A{"$allowed", bson.D{{"$subtract", bson.A{"$tokens", 1}}}, "$tokens"}}}}}}},
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+
+	var bucket struct {
+		Tokens  float64 `bson:"tokens"`
+		Allowed bool    `bson:"allowed"`
+	}
+	if err := collection.FindOneAndUpdate(ctx, bson.M{"_id": key}, update, opts).Decode(&bucket); err != nil {
+		return false, 0, err
+	}
+	if bucket.Allowed {
+		return true, 0, nil
+	}
+	return false, time.Duration((1 - bucket.Tokens) / budget.RatePerSecond * float64(time.Second)), nil
+}
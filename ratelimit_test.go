@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestTokenBucketTake(t *testing.T) {
+	budget := RateBudget{RatePerSecond: 2, Burst: 3}
+	start := time.Now()
+	steps := []struct {
+		name       string
+		at         time.Duration
+		wantOK     bool
+		wantRetry  time.Duration
+		wantTokens float64
+	}{
+		{"starts full", 0, true, 0, 2},
+		{"second of the burst", 0, true, 0, 1},
+		{"last of the burst", 0, true, 0, 0},
+		{"empty", 0, false, 500 * time.Millisecond, 0},
+		{"half a token refilled", 250 * time.Millisecond, false, 250 * time.Millisecond, 0.5},
+		{"refilled", 1250 * time.Millisecond, true, 0, 1.5},
+		{"refills up to the burst", time.Hour, true, 0, 2},
+	}
+	b := &tokenBucket{}
+	for _, s := range steps {
+		ok, retry := b.take(start.Add(s.at), budget)
+		if ok != s.wantOK || retry != s.wantRetry || b.tokens != s.wantTokens {
+			t.Errorf("%s: got %v, retry %v, %v tokens, want %v, retry %v, %v tokens",
+				s.name, ok, retry, b.tokens, s.wantOK, s.wantRetry, s.wantTokens)
+		}
+	}
+}
+
+func TestRateLimitRetryAfter(t *testing.T) {
+	log = logrus.New()
+	log.SetOutput(io.Discard)
+	savedConfig, savedLimiter := config, limiter
+	defer func() { config, limiter = savedConfig, savedLimiter }()
+	config.RateLimit.Search = RateBudget{RatePerSecond: 0.5, Burst: 2}
+	limiter = newMemoryLimiter()
+
+	handler := rateLimit(RATE_SEARCH, func(w http.ResponseWriter, r *http.Request) {})
+	tests := []struct {
+		name       string
+		remoteAddr string
+		wantCode   int
+		wantRetry  string
+	}{
+		{"first of the burst", "10.0.0.1:1000", http.StatusOK, ""},
+		{"last of the burst", "10.0.0.1:1001", http.StatusOK, ""},
+		{"over the budget", "10.0.0.1:1002", http.StatusTooManyRequests, "2"},
+		{"another client", "10.0.0.2:1000", http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/search", nil)
+		req.RemoteAddr = tt.remoteAddr
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		if rec.Code != tt.wantCode || rec.Header().Get("Retry-After") != tt.wantRetry {
+			t.Errorf("%s: got %d with Retry-After %q, want %d with %q",
+				tt.name, rec.Code, rec.Header().Get("Retry-After"), tt.wantCode, tt.wantRetry)
+		}
+	}
+}
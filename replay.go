@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// ReplayQuery is one production query with how many times it was searched
+type ReplayQuery struct {
+	Query string
+	Count int
+}
+
+// ReplayResult compares one query's results of the two configurations
+type ReplayResult struct {
+	ReplayQuery
+	Overlap    float64
+	RankShift  float64
+	NewItems   int
+	LatencyA   time.Duration
+	LatencyB   time.Duration
+	ResultsA   int
+	ResultsB   int
+	ErrA, ErrB error
+}
+
+// replayCommand replays the production queries against two configurations,
+// and reports overlap@k, rank changes and latency differences
+func replayCommand(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	source := fs.String("source", "searchs", "query source: searchs (the searchs collection) or log")
+	logPath := fs.String("log", "logrus.log", "logrus log file of the log source")
+	limit := fs.Int("limit", 100, "max number of queries replayed, the most searched first")
+	mode := fs.String("mode", MODE_SEARCH, "search mode: search, search-p or search-m")
+	itemsPath := fs.String("items", "", "items JSONL file for the in-memory store, empty searches the cluster")
+	configPath := fs.String("config", "", "config file of the current configuration, empty uses the current config")
+	comparePath := fs.String("compare", "", "config file of the candidate configuration")
+	k := fs.Int("k", EVAL_K, "depth of the overlap and rank comparison")
+	fs.Parse(args)
+
+	if *comparePath == "" {
+		return fmt.Errorf("the -compare config file is required")
+	}
+	var queries []ReplayQuery
+	var err error
+	switch *source {
+	case "searchs":
+		queries, err = loadReportedQueries(*limit)
+	case "log":
+		queries, err = loadLoggedQueries(*logPath, *limit)
+	default:
+		err = fmt.Errorf("unknown source %q", *source)
+	}
+	if err != nil {
+		return err
+	}
+
+	searcher, err := openSearcher(*itemsPath)
+	if err != nil {
+		return err
+	}
+	current, err := configFor(*configPath)
+	if err != nil {
+		return err
+	}
+	candidate, err := configFor(*comparePath)
+	if err != nil {
+		return err
+	}
+
+	// Warm up the connections and the index of both configurations, the
+	// first searches would be timed slower
+	if len(queries) > 0 {
+		withConfig(current, func() { timedSearch(searcher, *mode, queries[0].Query) })
+		withConfig(candidate, func() { timedSearch(searcher, *mode, queries[0].Query) })
+	}
+
+	var results []ReplayResult
+	for i, q := range queries {
+		r := ReplayResult{ReplayQuery: q}
+		var a, b []bson.M
+		runA := func() {
+			withConfig(current, func() {
+				a, r.LatencyA, r.ErrA = timedSearch(searcher, *mode, q.Query)
+			})
+		}
+		runB := func() {
+			withConfig(candidate, func() {
+				b, r.LatencyB, r.ErrB = timedSearch(searcher, *mode, q.Query)
+			})
+		}
+		// The second search of a query is served from warm caches, so the
+		// order alternates to not favor either configuration
+		if i%2 == 0 {
+			runA()
+			runB()
+		} else {
+			runB()
+			runA()
+		}
+		r.ResultsA, r.ResultsB = len(a), len(b)
+		r.Overlap, r.RankShift, r.NewItems = compareRankings(documentIds(a), documentIds(b), *k)
+		results = append(results, r)
+	}
+	printReplay(os.Stdout, results, *k)
+	return nil
+}
+
+// withConfig runs fn with the configuration swapped in, the pipeline
+// builders read the global config
+func withConfig(c Config, fn func()) {
+	saved := config
+	config = c
+	defer func() { config = saved }()
+	fn()
+}
+
+func timedSearch(searcher Searcher, mode, query string) ([]bson.M, time.Duration, error) {
+	start := time.Now()
+	results, err := runSearch(context.Background(), searcher, mode, query, defaultSearchOptions(mode), nil)
+	return results, time.Since(start), err
+}
+
+// loadReportedQueries gets the most searched queries of all users from
+// their histories in the searchs collection
+func loadReportedQueries(limit int) ([]ReplayQuery, error) {
+	client, err := GetMongoClient(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	collection := client.Database(DB).Collection(SEARCH_REPORT_COLLECTION)
+
+	unwindStage := bson.D{{"$unwind", "$searches"}}
+	groupStage := bson.D{{"$group", bson.D{{"_id", "$searches.query"}, {"count", bson.D{{"$sum", 1}}}}}}
+	sortStage := bson.D{{"$sort", bson.D{{"count", -1}, {"_id", 1}}}}
+	limitStage := bson.D{{"$limit", limit}}
+	cursor, err := collection.Aggregate(context.TODO(), bson.A{unwindStage, groupStage, sortStage, limitStage})
+	if err != nil {
+		return nil, err
+	}
+	var groups []struct {
+		Query string `bson:"_id"`
+		Count int    `bson:"count"`
+	}
+	if err = cursor.All(context.Background(), &groups); err != nil {
+		return nil, err
+	}
+	var queries []ReplayQuery
+	for _, g := range groups {
+		if g.Query != "" {
+			queries = append(queries, ReplayQuery{Query: g.Query, Count: g.Count})
+		}
+	}
+	return queries, nil
+}
+
+// loadLoggedQueries gets the most searched queries from the sampled
+// "search query served" entries of the logrus log, written at the info level,
+// or the "generated pipline finished" ones of a debug level log
+func loadLoggedQueries(path string, limit int) ([]ReplayQuery, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// A debug level log has both, the pipeline entries aren't sampled
+	served, pipelines := map[string]int{}, map[string]int{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+	for scanner.Scan() {
+		fields := parseLogFields(scanner.Text())
+		if fields["query"] == "" {
+			continue
+		}
+		switch fields["msg"] {
+		case SEARCH_QUERY_LOG:
+			served[fields["query"]]++
+		case "generated pipline finished":
+			pipelines[fields["query"]]++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	counts := served
+	if len(pipelines) > 0 {
+		counts = pipelines
+	}
+
+	if len(counts) == 0 {
+		return nil, fmt.Errorf("no logged search queries in %s, they're the %q entries written at the info level", path, SEARCH_QUERY_LOG)
+	}
+
+	var queries []ReplayQuery
+	for q, c := range counts {
+		queries = append(queries, ReplayQuery{Query: q, Count: c})
+	}
+	sort.Slice(queries, func(i, j int) bool {
+		if queries[i].Count == queries[j].Count {
+			return queries[i].Query < queries[j].Query
+		}
+		return queries[i].Count > queries[j].Count
+	})
+	if len(queries) > limit {
+		queries = queries[:limit]
+	}
+	return queries, nil
+}
+
+// parseLogFields parses the string fields of a logrus JSON formatter line,
+// or the key=value and key="quoted value" pairs of a text formatter line
+func parseLogFields(line string) map[string]string {
+	fields := map[string]string{}
+	if strings.HasPrefix(line, "{") {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err == nil {
+			for k, v := range entry {
+				if s, ok := v.(string); ok {
+					fields[k] = s
+				}
+			}
+		}
+		return fields
+	}
+	for len(line) > 0 {
+		line = strings.TrimLeft(line, " ")
+		eq := strings.IndexByte(line, '=')
+		if eq <= 0 {
+			break
+		}
+		key := line[:eq]
+		line = line[eq+1:]
+		if strings.HasPrefix(line, `"`) {
+			end := 1
+			for end < len(line) && line[end] != '"' {
+				if line[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(line) {
+				break
+			}
+			value, err := strconv.Unquote(line[:end+1])
+			if err == nil {
+				fields[key] = value
+			}
+			line = line[end+1:]
+			continue
+		}
+		end := strings.IndexByte(line, ' ')
+		if end < 0 {
+			end = len(line)
+		}
+		fields[key] = line[:end]
+		line = line[end:]
+	}
+	return fields
+}
+
+// compareRankings gets overlap@k of the two rankings, the mean rank shift
+// of the shared items and how many of the candidate's items are new. The
+// overlap is over the longer ranking, so two identical short rankings
+// overlap fully
+func compareRankings(a, b []string, k int) (overlap, rankShift float64, newItems int) {
+	if len(a) > k {
+		a = a[:k]
+	}
+	if len(b) > k {
+		b = b[:k]
+	}
+	rankA := map[string]int{}
+	for i, id := range a {
+		rankA[id] = i
+	}
+	shared := 0
+	for i, id := range b {
+		if j, ok := rankA[id]; ok {
+			shared++
+			rankShift += math.Abs(float64(i - j))
+		} else {
+			newItems++
+		}
+	}
+	if shared > 0 {
+		rankShift /= float64(shared)
+	}
+	longest := len(a)
+	if len(b) > longest {
+		longest = len(b)
+	}
+	if longest == 0 {
+		return 1, 0, 0
+	}
+	return float64(shared) / float64(longest), rankShift, newItems
+}
+
+func printReplay(out io.Writer, results []ReplayResult, k int) {
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Overlap < results[j].Overlap
+	})
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "QUERY\tCOUNT\tOVERLAP@%d\tRANK SHIFT\tNEW\tRESULTS A\tRESULTS B\tLATENCY A\tLATENCY B\n", k)
+	var overlap, shift float64
+	var latencyA, latencyB []time.Duration
+	failed := 0
+	for _, r := range results {
+		if r.ErrA != nil || r.ErrB != nil {
+			failed++
+			fmt.Fprintf(w, "%s\t%d\terror: %v / %v\n", r.Query, r.Count, r.ErrA, r.ErrB)
+			continue
+		}
+		overlap += r.Overlap
+		shift += r.RankShift
+		latencyA = append(latencyA, r.LatencyA)
+		latencyB = append(latencyB, r.LatencyB)
+		fmt.Fprintf(w, "%s\t%d\t%.2f\t%.2f\t%d\t%d\t%d\t%s\t%s\n", r.Query, r.Count, r.Overlap, r.RankShift,
+			r.NewItems, r.ResultsA, r.ResultsB, r.LatencyA.Round(time.Microsecond), r.LatencyB.Round(time.Microsecond))
+	}
+	w.Flush()
+
+	fmt.Fprintf(out, "\n%d queries replayed, %d failed\n", len(results), failed)
+	n := len(latencyA)
+	if n == 0 {
+		return
+	}
+	fmt.Fprintf(out, "mean overlap@%d %.2f, mean rank shift %.2f\n", k, overlap/float64(n), shift/float64(n))
+	fmt.Fprintf(out, "latency p50 %s -> %s, p95 %s -> %s\n",
+		percentile(latencyA, 50), percentile(latencyB, 50), percentile(latencyA, 95), percentile(latencyB, 95))
+}
+
+func percentile(durations []time.Duration, p int) time.Duration {
+	sorted := append([]time.Duration(nil), durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	i := (len(sorted)*p+99)/100 - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i].Round(time.Microsecond)
+}
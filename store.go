@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Searcher runs the search pipelines built by the pipeline builders
+type Searcher interface {
+	Aggregate(ctx context.Context, pipeline []bson.D) ([]bson.M, error)
+}
+
+// mongoSearcher runs the pipelines on the items collection of the cluster
+type mongoSearcher struct {
+	collection *mongo.Collection
+}
+
+func newMongoSearcher() (*mongoSearcher, error) {
+	client, err := GetMongoClient(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return &mongoSearcher{collection: client.Database(DB).Collection(COLLECTION)}, nil
+}
+
+func (s *mongoSearcher) Aggregate(ctx context.Context, pipeline []bson.D) ([]bson.M, error) {
+	cursor, err := s.collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	var results []bson.M
+	if err = cursor.All(ctx, &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// memoryStore keeps the items in memory and runs the pipelines with a
+// simple term matching scorer instead of Atlas search. It understands the
+// compound should clauses of the pipeline builders (text, queryString and
+// moreLikeThis with boosts) and the $skip, $limit and $project stages, which
+// is enough to compare pipeline configurations without a cluster
+type memoryStore struct {
+	items []bson.M
+}
+
+// loadMemoryStore loads the items from a JSONL file, one item per line in
+// plain or extended JSON
+func loadMemoryStore(path string) (*memoryStore, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	store := &memoryStore{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		var item bson.M
+		if err := bson.UnmarshalExtJSON([]byte(text), false, &item); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		store.items = append(store.items, item)
+	}
+	return store, scanner.Err()
+}
+
+func (s *memoryStore) Aggregate(ctx context.Context, pipeline []bson.D) ([]bson.M, error) {
+	type scored struct {
+		item  bson.M
+		score float64
+	}
+	var hits []scored
+	searched := false
+	var results []bson.M
+
+	for _, stage := range pipeline {
+		if len(stage) != 1 {
+			return nil, fmt.Errorf("unsupported stage %v", stage)
+		}
+		switch stage[0].Key {
+		case "$search":
+			search, _ := stage[0].Value.(bson.D)
+			compound, _ := lookup(search, "compound").(bson.D)
+			should, _ := lookup(compound, "should").(bson.A)
+			for _, item := range s.items {
+				score := 0.0
+				for _, clause := range should {
+					score += scoreClause(clause, item)
+				}
+				if score > 0 {
+					hits = append(hits, scored{item: item, score: score})
+				}
+			}
+			sort.SliceStable(hits, func(i, j int) bool {
+				return hits[i].score > hits[j].score
+			})
+			searched = true
+		case "$skip":
+			n := toInt(stage[0].Value)
+			if n > len(hits) {
+				n = len(hits)
+			}
+			hits = hits[n:]
+		case "$limit":
+			n := toInt(stage[0].Value)
+			if n < len(hits) {
+				hits = hits[:n]
+			}
+		case "$project":
+			projection, _ := stage[0].Value.(bson.D)
+			for _, h := range hits {
+				results = append(results, project(h.item, h.score, projection))
+			}
+		case "$sort":
+			// The memory store keeps the search score order
+		default:
+			return nil, fmt.Errorf("unsupported stage %s", stage[0].Key)
+		}
+	}
+	if !searched {
+		return nil, fmt.Errorf("memory store only runs $search pipelines")
+	}
+	if results == nil {
+		for _, h := range hits {
+			results = append(results, h.item)
+		}
+	}
+	return results, nil
+}
+
+// scoreClause scores one compound should clause against the item
+func scoreClause(clause interface{}, item bson.M) float64 {
+	d, ok := clause.(bson.D)
+	if !ok || len(d) != 1 {
+		return 0
+	}
+	op, _ := d[0].Value.(bson.D)
+	boost := 1.0
+	if score, ok := lookup(op, "score").(bson.D); ok {
+		if b, ok := lookup(score, "boost").(bson.D); ok {
+			boost = toFloat(lookup(b, "value"))
+		}
+	}
+
+	switch d[0].Key {
+	case "text":
+		terms := tokenize(lookup(op, "query"))
+		path, _ := lookup(op, "path").(string)
+		return boost * matchRatio(terms, tokenize(item[path]))
+	case "queryString":
+		var terms []string
+		for _, t := range tokenize(lookup(op, "query")) {
+			if t != "or" && t != "and" {
+				terms = append(terms, t)
+			}
+		}
+		path, _ := lookup(op, "defaultPath").(string)
+		return boost * matchRatio(terms, tokenize(item[path]))
+	case "moreLikeThis":
+		like, _ := lookup(op, "like").(bson.M)
+		var terms, fields []string
+		for field, v := range like {
+			terms = append(terms, tokenize(v)...)
+			fields = append(fields, tokenize(item[field])...)
+		}
+		return boost * matchRatio(terms, fields)
+	}
+	return 0
+}
+
+// matchRatio is the share of the distinct query terms found in the field
+func matchRatio(terms, field []string) float64 {
+	if len(terms) == 0 || len(field) == 0 {
+		return 0
+	}
+	in := map[string]bool{}
+	for _, t := range field {
+		in[t] = true
+	}
+	wanted := map[string]bool{}
+	matched := 0
+	for _, t := range terms {
+		if wanted[t] {
+			continue
+		}
+		wanted[t] = true
+		if in[t] {
+			matched++
+		}
+	}
+	return float64(matched) / float64(len(wanted))
+}
+
+// tokenize lowercases and splits the strings into words, every CJK
+// character is one token
+func tokenize(v interface{}) []string {
+	var tokens []string
+	for _, s := range stringValues(v) {
+		var word []rune
+		flush := func() {
+			if len(word) != 0 {
+				tokens = append(tokens, string(word))
+				word = word[:0]
+			}
+		}
+		for _, r := range strings.ToLower(s) {
+			switch {
+			case unicode.Is(unicode.Han, r):
+				flush()
+				tokens = append(tokens, string(r))
+			case unicode.IsLetter(r) || unicode.IsDigit(r):
+				word = append(word, r)
+			default:
+				flush()
+			}
+		}
+		flush()
+	}
+	return tokens
+}
+
+// project applies the inclusion projection, the searchScore meta field gets
+// the memory store score
+func project(item bson.M, score float64, projection bson.D) bson.M {
+	out := bson.M{}
+	for _, e := range projection {
+		switch v := e.Value.(type) {
+		case bson.D:
+			if lookup(v, "$meta") == "searchScore" {
+				out[e.Key] = score
+			}
+		default:
+			if toInt(v) == 1 {
+				if value, ok := item[e.Key]; ok {
+					out[e.Key] = value
+				}
+			}
+		}
+	}
+	return out
+}
+
+func lookup(d bson.D, key string) interface{} {
+	for _, e := range d {
+		if e.Key == key {
+			return e.Value
+		}
+	}
+	return nil
+}
+
+func toInt(v interface{}) int {
+	return int(toFloat(v))
+}
+
+func toFloat(v interface{}) float64 {
+	switch n := v.(type) {
+	case int:
+		return float64(n)
+	case int32:
+		return float64(n)
+	case int64:
+		return float64(n)
+	case float64:
+		return n
+	}
+	return 0
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// LearnedTag is a productTag or discountTag value learned from the user's
+// clicks. Score is the decayed click evidence, Confidence is the tag's share
+// of all the user's evidence
+type LearnedTag struct {
+	Tag        string    `json:"tag" bson:"tag"`
+	Score      float64   `json:"score" bson:"score"`
+	Confidence float64   `json:"confidence" bson:"confidence"`
+	UpdatedAt  time.Time `json:"updatedAt" bson:"updatedAt"`
+}
+
+// runTagLearner learns the customers' tags from their clicks on every
+// configured interval until the context is done
+func runTagLearner(ctx context.Context) {
+	c := config.LearnedTags
+	if c.IntervalMinutes <= 0 {
+		log.Info("tag learner is disabled")
+		return
+	}
+	ticker := time.NewTicker(time.Duration(c.IntervalMinutes) * time.Minute)
+	defer ticker.Stop()
+
+	for {
+		if err := learnAllCustomerTags(ctx); err != nil {
+			log.WithFields(
+				logrus.Fields{
+					"err": err,
+				}).Error("learn customer tags failed")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// learnAllCustomerTags scans every customer's new clicks and updates the
+// learned tags
+func learnAllCustomerTags(ctx context.Context) error {
+	client, err := GetMongoClient(ctx)
+	if err != nil {
+		return err
+	}
+	collection := client.Database(DB).Collection(CUSTOMER_COLLECTION)
+
+	cursor, err := collection.Find(ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	updated := 0
+	for cursor.Next(ctx) {
+		var customer Customer
+		if err := cursor.Decode(&customer); err != nil {
+			log.WithFields(
+				logrus.Fields{
+					"err": err,
+				}).Error("decode customer failed")
+			continue
+		}
+		if err := learnCustomerTags(ctx, &customer, time.Now()); err != nil {
+			log.WithFields(
+				logrus.Fields{
+					"user": customer.Name,
+					"err":  err,
+				}).Error("learn customer tags failed")
+			continue
+		}
+		updated++
+	}
+	log.WithFields(
+		logrus.Fields{
+			"customers": updated,
+		}).Info("learned customer tags")
+	return cursor.Err()
+}
+
+// learnCustomerTags adds the clicks since the last scan as tag evidence,
+// decays the existing evidence and saves the learned tags. The scan mark
+// moves to the newest click consumed, so a click recorded during the scan is
+// read by the next one
+func learnCustomerTags(ctx context.Context, customer *Customer, now time.Time) error {
+	client, err := GetMongoClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	events, err := clickEvents(ctx, customer.Name, customer.LearnedTagsScannedAt)
+	if err != nil {
+		return err
+	}
+	views := newClicks(customer.ViewHistory, events, customer.LearnedTagsScannedAt)
+
+	itemTags := map[string][]string{}
+	if len(views) != 0 {
+		var IDs []string
+		for _, v := range views {
+			IDs = append(IDs, v.DocumentId)
+		}
+		findOptions := options.Find().SetProjection(bson.M{"_id": 0, "documentId": 1, "productTag": 1, "discountTag": 1})
+		icollection := client.Database(DB).Collection(COLLECTION)
+		cursor, err := icollection.Find(ctx, bson.M{"documentId": bson.M{"$in": IDs}}, findOptions)
+		if err != nil {
+			return err
+		}
+		var items []bson.M
+		if err = cursor.All(ctx, &items); err != nil {
+			return err
+		}
+		for _, item := range items {
+			id, _ := item["documentId"].(string)
+			itemTags[id] = append(stringValues(item["productTag"]), stringValues(item["discountTag"])...)
+		}
+	}
+
+	learned := learnTags(customer.LearnedTags, views, itemTags, now, config.LearnedTags)
+
+	set := bson.M{"learnedTags": learned}
+	if len(views) != 0 {
+		set["learnedTagsScannedAt"] = views[len(views)-1].ViewTime
+	}
+	collection := client.Database(DB).Collection(CUSTOMER_COLLECTION)
+	_, err = collection.UpdateOne(ctx, bson.M{"name": customer.Name}, bson.M{"$set": set})
+	return err
+}
+
+// clickEvents gets the user's click events since the time, they keep the
+// clicks the capped viewHistory has dropped
+func clickEvents(ctx context.Context, user string, since time.Time) ([]ItemReport, error) {
+	client, err := GetMongoClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	collection := client.Database(DB).Collection(EVENT_COLLECTION)
+	ensureEventUserIndex(ctx, collection)
+
+	filter := bson.D{{"name", user}, {"type", EVENT_CLICK}, {"time", bson.D{{"$gt", since}}}}
+	findOptions := options.Find().SetProjection(bson.M{"_id": 0, "documentId": 1, "time": 1})
+	cursor, err := collection.Find(ctx, filter, findOptions)
+	if err != nil {
+		return nil, err
+	}
+	var events []Event
+	if err = cursor.All(ctx, &events); err != nil {
+		return nil, err
+	}
+	var clicks []ItemReport
+	for _, e := range events {
+		clicks = append(clicks, ItemReport{DocumentId: e.DocumentId, ViewTime: e.Time})
+	}
+	return clicks, nil
+}
+
+// newClicks merges the viewHistory entries and the click events after the
+// time, oldest first. A click is in both with the same view time, it's
+// counted once
+func newClicks(history, events []ItemReport, since time.Time) []ItemReport {
+	seen := map[string]bool{}
+	var clicks []ItemReport
+	for _, list := range [][]ItemReport{history, events} {
+		for _, c := range list {
+			// MongoDB keeps the times in milliseconds
+			key := fmt.Sprintf("%s@%d", c.DocumentId, c.ViewTime.UnixMilli())
+			if !c.ViewTime.After(since) || seen[key] {
+				continue
+			}
+			seen[key] = true
+			clicks = append(clicks, c)
+		}
+	}
+	sort.SliceStable(clicks, func(i, j int) bool {
+		return clicks[i].ViewTime.Before(clicks[j].ViewTime)
+	})
+	return clicks
+}
+
+// learnTags decays the previous tag scores, adds every new click's item tags
+// weighted by the click's recency, and keeps the strongest tags
+func learnTags(previous []LearnedTag, views []ItemReport, itemTags map[string][]string, now time.Time, c LearnedTagsConfig) []LearnedTag {
+	decay := func(since time.Time) float64 {
+		if c.HalfLifeHours <= 0 {
+			return 1
+		}
+		age := math.Max(now.Sub(since).Hours(), 0)
+		return math.Pow(0.5, age/c.HalfLifeHours)
+	}
+
+	scores := map[string]float64{}
+	for _, t := range previous {
+		scores[t.Tag] += t.Score * decay(t.UpdatedAt)
+	}
+	for _, v := range views {
+		for _, tag := range itemTags[v.DocumentId] {
+			scores[tag] += decay(v.ViewTime)
+		}
+	}
+
+	total := 0.0
+	for _, score := range scores {
+		total += score
+	}
+
+	learned := []LearnedTag{}
+	for tag, score := range scores {
+		if score < c.MinScore {
+			continue
+		}
+		learned = append(learned, LearnedTag{
+			Tag:        tag,
+			Score:      score,
+			Confidence: score / total,
+			UpdatedAt:  now,
+		})
+	}
+	sort.Slice(learned, func(i, j int) bool {
+		if learned[i].Score == learned[j].Score {
+			return learned[i].Tag < learned[j].Tag
+		}
+		return learned[i].Score > learned[j].Score
+	})
+	if c.MaxTags > 0 && len(learned) > c.MaxTags {
+		learned = learned[:c.MaxTags]
+	}
+	return learned
+}
+
+// confidentTags gets the learned tags with enough confidence to personalize with
+func confidentTags(learned []LearnedTag, minConfidence float64) []string {
+	var tags []string
+	for _, t := range learned {
+		if t.Confidence >= minConfidence {
+			tags = append(tags, t.Tag)
+		}
+	}
+	return tags
+}
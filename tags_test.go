@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewClicks(t *testing.T) {
+	scanned := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	at := func(minutes int) time.Time { return scanned.Add(time.Duration(minutes) * time.Minute) }
+	click := func(id string, minutes int) ItemReport { return ItemReport{DocumentId: id, ViewTime: at(minutes)} }
+	tests := []struct {
+		name    string
+		history []ItemReport
+		events  []ItemReport
+		want    []ItemReport
+	}{
+		{
+			name:    "a click in both is counted once",
+			history: []ItemReport{click("a", 1), click("b", 2)},
+			events:  []ItemReport{click("a", 1), click("b", 2)},
+			want:    []ItemReport{click("a", 1), click("b", 2)},
+		},
+		{
+			name:    "the events keep the clicks dropped from the history",
+			history: []ItemReport{click("c", 3)},
+			events:  []ItemReport{click("a", 1), click("b", 2), click("c", 3)},
+			want:    []ItemReport{click("a", 1), click("b", 2), click("c", 3)},
+		},
+		{
+			name:    "the clicks not in the events yet",
+			history: []ItemReport{click("a", 1), click("b", 2)},
+			events:  []ItemReport{click("a", 1)},
+			want:    []ItemReport{click("a", 1), click("b", 2)},
+		},
+		{
+			name:    "the clicks up to the scan mark are skipped",
+			history: []ItemReport{click("a", -1), click("b", 0), click("c", 1)},
+			events:  []ItemReport{click("b", 0)},
+			want:    []ItemReport{click("c", 1)},
+		},
+		{
+			name:    "the same item clicked twice",
+			history: []ItemReport{click("a", 1), click("a", 2)},
+			want:    []ItemReport{click("a", 1), click("a", 2)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := newClicks(tt.history, tt.events, scanned)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d clicks %v, want %v", len(got), got, tt.want)
+			}
+			for i := range got {
+				if got[i].DocumentId != tt.want[i].DocumentId || !got[i].ViewTime.Equal(tt.want[i].ViewTime) {
+					t.Errorf("click %d is %s at %v, want %s at %v", i, got[i].DocumentId, got[i].ViewTime, tt.want[i].DocumentId, tt.want[i].ViewTime)
+				}
+			}
+		})
+	}
+}
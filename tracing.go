@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"go.mongodb.org/mongo-driver/event"
+	"go.opentelemetry.io/contrib/instrumentation/go.mongodb.org/mongo-driver/mongo/otelmongo"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Trace exporters
+const (
+	TRACE_NONE   = "none"
+	TRACE_STDOUT = "stdout"
+	TRACE_OTLP   = "otlp"
+)
+
+// The tracer of the search stages, it's a no-op until setupTracing
+var tracer = otel.Tracer("demo")
+
+// setupTracing installs the tracer provider of the configured exporter, and
+// returns the function flushing the spans on shutdown
+func setupTracing(ctx context.Context) (func(context.Context) error, error) {
+	c := config.Tracing
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch c.Exporter {
+	case "", TRACE_NONE:
+		return func(context.Context) error { return nil }, nil
+	case TRACE_STDOUT:
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case TRACE_OTLP:
+		var opts []otlptracehttp.Option
+		if c.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(c.Endpoint))
+		}
+		if c.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(ctx, opts...)
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q, use none, stdout or otlp", c.Exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(c.SampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", c.ServiceName),
+			attribute.String("service.version", buildVersion()),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown, nil
+}
+
+// traceHandler starts a server span for every request, continuing the
+// trace of the caller
+func traceHandler(next http.Handler) http.Handler {
+	return otelhttp.NewHandler(next, "http",
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return r.Method + " " + r.URL.Path
+		}))
+}
+
+// startSpan starts the span of one search stage
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan records the stage's error and ends its span
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// detachContext is a context without the cancellation of the request, which
+// keeps its metric labels, its request ID and its span, for the work
+// outliving the request
+func detachContext(from context.Context) context.Context {
+	ctx := withLabels(context.Background(), from)
+	if id := requestIDFrom(from); id != "" {
+		ctx = context.WithValue(ctx, requestIDKey{}, id)
+	}
+	return trace.ContextWithSpan(ctx, trace.SpanFromContext(from))
+}
+
+// mongoMonitor chains the metrics monitor with the tracing one, every
+// MongoDB command becomes a span of the stage running it
+func mongoMonitor() *event.CommandMonitor {
+	monitors := []*event.CommandMonitor{
+		commandMonitor(),
+		otelmongo.NewMonitor(otelmongo.WithCommandAttributeDisabled(!config.Tracing.MongoStatements)),
+	}
+	return &event.CommandMonitor{
+		Started: func(ctx context.Context, e *event.CommandStartedEvent) {
+			for _, m := range monitors {
+				if m.Started != nil {
+					m.Started(ctx, e)
+				}
+			}
+		},
+		Succeeded: func(ctx context.Context, e *event.CommandSucceededEvent) {
+			for _, m := range monitors {
+				if m.Succeeded != nil {
+					m.Succeeded(ctx, e)
+				}
+			}
+		},
+		Failed: func(ctx context.Context, e *event.CommandFailedEvent) {
+			for _, m := range monitors {
+				if m.Failed != nil {
+					m.Failed(ctx, e)
+				}
+			}
+		},
+	}
+}
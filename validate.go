@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// FieldError is the problem of one request field
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// validator collects the field errors of a request, so the client gets all
+// of them in one 400 response
+type validator struct {
+	Errors []FieldError `json:"errors"`
+}
+
+func (v *validator) fail(field, format string, args ...interface{}) {
+	v.Errors = append(v.Errors, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// reject answers 400 with the field errors, it tells if there were any
+func (v *validator) reject(w http.ResponseWriter) bool {
+	if len(v.Errors) == 0 {
+		return false
+	}
+	// Convert the data to JSON
+	jsonData, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, "Error converting data", http.StatusInternalServerError)
+		return true
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write(jsonData)
+	return true
+}
+
+// intParam gets the integer query parameter in [min, max], def when it's
+// missing
+func (v *validator) intParam(r *http.Request, name string, def, min, max int) int {
+	s := r.URL.Query().Get(name)
+	if s == "" {
+		return def
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		v.fail(name, "must be an integer")
+		return def
+	}
+	if n < min || n > max {
+		v.fail(name, "must be between %d and %d", min, max)
+		return def
+	}
+	return n
+}
+
+// page gets the 1-based result page
+func (v *validator) page(r *http.Request) int {
+	return v.intParam(r, "page", 1, 1, config.Limits.MaxPage)
+}
+
+// query gets the search keywords, at most MaxQueryLength characters of
+// printable UTF-8
+func (v *validator) query(r *http.Request) string {
+	query := r.URL.Query().Get("query")
+	v.text("query", query, config.Limits.MaxQueryLength)
+	return query
+}
+
+// user gets the current user, see currentUser. The user parameter isn't
+// accepted, the user is the header of an authenticated front end
+func (v *validator) user(r *http.Request) string {
+	if r.URL.Query().Has("user") {
+		v.fail("user", "is not accepted, the user is the %s header of an authenticated front end", USER_HEADER)
+	}
+	user := currentUser(r)
+	v.text("user", user, config.Limits.MaxFieldLength)
+	return user
+}
+
+// boolParam gets the true or false query parameter, false when it's missing
+func (v *validator) boolParam(r *http.Request, name string) bool {
+	switch r.URL.Query().Get(name) {
+	case "", "false":
+		return false
+	case "true":
+		return true
+	}
+	v.fail(name, "must be true or false")
+	return false
+}
+
+// oneOf checks the value is one of the allowed ones
+func (v *validator) oneOf(field, value string, allowed ...string) {
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+	v.fail(field, "must be one of %s", strings.Join(allowed, ", "))
+}
+
+// text checks the string is printable UTF-8 of at most max characters
+func (v *validator) text(field, s string, max int) {
+	if !utf8.ValidString(s) {
+		v.fail(field, "must be valid UTF-8")
+		return
+	}
+	if n := utf8.RuneCountInString(s); n > max {
+		v.fail(field, "must be at most %d characters", max)
+		return
+	}
+	if strings.IndexFunc(s, unicode.IsControl) >= 0 {
+		v.fail(field, "must not contain control characters")
+	}
+}
+
+// decodeJSON decodes the request body of at most MaxBodyBytes into dst, the
+// unknown fields, the mistyped fields and any trailing data are errors. It
+// tells if dst was decoded
+func (v *validator) decodeJSON(w http.ResponseWriter, r *http.Request, dst interface{}) bool {
+	r.Body = http.MaxBytesReader(w, r.Body, config.Limits.MaxBodyBytes)
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+
+	err := dec.Decode(dst)
+	if err == nil {
+		if dec.Decode(&struct{}{}) != io.EOF {
+			v.fail("body", "must be a single JSON object")
+			return false
+		}
+		return true
+	}
+
+	var maxErr *http.MaxBytesError
+	var typeErr *json.UnmarshalTypeError
+	var syntaxErr *json.SyntaxError
+	switch {
+	case errors.As(err, &maxErr):
+		v.fail("body", "must be at most %d bytes", maxErr.Limit)
+	case errors.As(err, &typeErr):
+		v.fail(typeErr.Field, "must be a %s", typeErr.Type)
+	case errors.As(err, &syntaxErr), errors.Is(err, io.ErrUnexpectedEOF):
+		v.fail("body", "must be valid JSON")
+	case errors.Is(err, io.EOF):
+		v.fail("body", "is required")
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		// encoding/json has no error type for the unknown fields
+		v.fail(strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`), "is not allowed")
+	default:
+		v.fail("body", "%v", err)
+	}
+	return false
+}
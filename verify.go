@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Startup modes
+const (
+	STARTUP_REFUSE  = "refuse"  // exit when a check fails
+	STARTUP_DEGRADE = "degrade" // serve, but the search endpoints answer 503 when the search index is broken
+	STARTUP_SKIP    = "skip"    // don't check
+)
+
+// Diagnostic levels
+const (
+	DIAG_ERROR = "error"
+	DIAG_WARN  = "warn"
+)
+
+// Diagnostic is one failed startup check
+type Diagnostic struct {
+	Check   string `json:"check"`
+	Level   string `json:"level"`
+	Message string `json:"message"`
+}
+
+// The collections the server needs, the optional ones are created on the
+// first write
+var requiredCollections = map[string]bool{
+	COLLECTION:                  true,
+	CUSTOMER_COLLECTION:         true,
+	MARKETING_CONFIG_COLLECTION: false,
+	SEARCH_REPORT_COLLECTION:    false,
+	EVENT_COLLECTION:            false,
+}
+
+// The startup diagnostics, the search index ones are replaced by the
+// rechecks while serving degraded
+var startupDiagnostics []Diagnostic
+var diagnosticsMu sync.RWMutex
+
+// verifyStartup checks the collections, the search index status and the
+// search index mappings of the fields the pipelines search
+func verifyStartup(ctx context.Context) []Diagnostic {
+	var diags []Diagnostic
+	client, err := GetMongoClient(ctx)
+	if err != nil {
+		return append(diags, Diagnostic{"mongo", DIAG_ERROR, fmt.Sprintf("connect to MongoDB failed: %v", err)})
+	}
+
+	names, err := client.Database(DB).ListCollectionNames(ctx, bson.M{})
+	if err != nil {
+		return append(diags, Diagnostic{"collections", DIAG_ERROR, fmt.Sprintf("list collections of %s failed: %v", DB, err)})
+	}
+	existing := map[string]bool{}
+	for _, name := range names {
+		existing[name] = true
+	}
+	for name, required := range requiredCollections {
+		if existing[name] {
+			continue
+		}
+		if required {
+			diags = append(diags, Diagnostic{"collections", DIAG_ERROR, fmt.Sprintf("collection %s.%s is missing", DB, name)})
+		} else {
+			diags = append(diags, Diagnostic{"collections", DIAG_WARN, fmt.Sprintf("collection %s.%s is missing, it's created on the first write", DB, name)})
+		}
+	}
+
+	return append(diags, verifySearchIndex(ctx)...)
+}
+
+// verifySearchIndex checks the search index is READY, and maps the required
+// fields
+func verifySearchIndex(ctx context.Context) []Diagnostic {
+	client, err := GetMongoClient(ctx)
+	if err != nil {
+		return []Diagnostic{{"mongo", DIAG_ERROR, fmt.Sprintf("connect to MongoDB failed: %v", err)}}
+	}
+	live, err := getLiveIndex(ctx, client.Database(DB).Collection(COLLECTION), SEARCH_INDEX)
+	if err != nil {
+		return []Diagnostic{{"search index", DIAG_ERROR, fmt.Sprintf("list search indexes of %s failed: %v", COLLECTION, err)}}
+	}
+	if live == nil {
+		return []Diagnostic{{"search index", DIAG_ERROR, fmt.Sprintf("search index %s is missing on %s, create it with `go run . index apply`", SEARCH_INDEX, COLLECTION)}}
+	}
+
+	var diags []Diagnostic
+	if live.Status != "READY" || !live.Queryable {
+		diags = append(diags, Diagnostic{"search index", DIAG_ERROR, fmt.Sprintf("search index %s is %s, queryable %t", SEARCH_INDEX, live.Status, live.Queryable)})
+	}
+	mappings, _ := live.LatestDefinition["mappings"].(bson.M)
+	if dynamic, _ := mappings["dynamic"].(bool); dynamic {
+		return diags
+	}
+	fields, _ := mappings["fields"].(bson.M)
+	var missing []string
+	for _, field := range config.Startup.RequiredFields {
+		if _, ok := fields[field]; !ok {
+			missing = append(missing, field)
+		}
+	}
+	if len(missing) != 0 {
+		diags = append(diags, Diagnostic{"search index", DIAG_ERROR, fmt.Sprintf("search index %s doesn't map %s, compare it with `go run . index diff`", SEARCH_INDEX, strings.Join(missing, ", "))})
+	}
+	return diags
+}
+
+// runStartupChecks runs the startup checks of the configured mode, it
+// exits in refuse mode when a check fails
+func runStartupChecks(ctx context.Context) {
+	mode := config.Startup.Mode
+	if mode == STARTUP_SKIP {
+		return
+	}
+	diags := verifyStartup(ctx)
+	diagnosticsMu.Lock()
+	startupDiagnostics = diags
+	diagnosticsMu.Unlock()
+
+	failed := false
+	for _, d := range diags {
+		fmt.Fprintf(os.Stderr, "startup check %s: %s: %s\n", d.Check, d.Level, d.Message)
+		entry := log.WithFields(
+			logrus.Fields{
+				"check":   d.Check,
+				"message": d.Message,
+			})
+		if d.Level == DIAG_ERROR {
+			failed = true
+			entry.Error("startup check failed")
+		} else {
+			entry.Warn("startup check warning")
+		}
+	}
+	if failed && mode == STARTUP_REFUSE {
+		log.Fatal("startup checks failed, refusing to serve")
+	}
+	if failed {
+		fmt.Fprintln(os.Stderr, "startup checks failed, serving degraded")
+	}
+}
+
+// searchUnavailable gets the startup errors that break the search, none
+// when the search works
+func searchUnavailable() []Diagnostic {
+	diagnosticsMu.RLock()
+	defer diagnosticsMu.RUnlock()
+	var diags []Diagnostic
+	for _, d := range startupDiagnostics {
+		if d.Level == DIAG_ERROR && d.Check != "collections" {
+			diags = append(diags, d)
+		}
+	}
+	return diags
+}
+
+// requireSearch answers 503 with the diagnostics instead of searching when
+// the server runs degraded without a working search index
+func requireSearch(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if diags := searchUnavailable(); len(diags) != 0 {
+			var messages []string
+			for _, d := range diags {
+				messages = append(messages, d.Message)
+			}
+			http.Error(w, "Search unavailable: "+strings.Join(messages, "; "), http.StatusServiceUnavailable)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// runSearchRecheck checks the search index again every recheckSeconds while
+// it breaks the search, so the search endpoints serve again once MongoDB is
+// back or the index is READY
+func runSearchRecheck(ctx context.Context) {
+	if config.Startup.RecheckSeconds <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(config.Startup.RecheckSeconds) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if len(searchUnavailable()) == 0 {
+			continue
+		}
+		checkCtx, cancel := context.WithTimeout(ctx, HEALTH_CHECK_TIMEOUT)
+		index := verifySearchIndex(checkCtx)
+		cancel()
+
+		// Keep the other checks, and replace the search index ones
+		diagnosticsMu.Lock()
+		diags := index
+		for _, d := range startupDiagnostics {
+			if d.Check == "collections" {
+				diags = append(diags, d)
+			}
+		}
+		startupDiagnostics = diags
+		diagnosticsMu.Unlock()
+
+		if len(searchUnavailable()) == 0 {
+			log.Info("search index check passed, search serving again")
+		}
+	}
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Watcher Config
+const (
+	RESUME_TOKEN_COLLECTION = "change_stream_tokens"
+	WATCH_RETRY_PERIOD      = 5 * time.Second
+)
+
+// ChangeEvent is one change of a watched collection, from the change stream
+// or from polling
+type ChangeEvent struct {
+	Collection   string
+	Operation    string
+	DocumentKey  interface{}
+	FullDocument bson.M
+}
+
+// The functions called on every catalog change, they are registered before
+// the watchers start
+var changeListeners []func(ChangeEvent)
+
+// onCatalogChange registers the function called on every change of the
+// watched collections
+func onCatalogChange(fn func(ChangeEvent)) {
+	changeListeners = append(changeListeners, fn)
+}
+
+// runCatalogWatcher watches the collection until the context is done. It
+// resumes the change stream from the persisted resume token, and falls back
+// to polling on clusters without change streams
+func runCatalogWatcher(ctx context.Context, name string) {
+	if !config.Watcher.Enabled {
+		return
+	}
+	for {
+		err := watchCollection(ctx, name)
+		if ctx.Err() != nil {
+			return
+		}
+		if isChangeStreamUnsupported(err) {
+			log.WithFields(
+				logrus.Fields{
+					"collection": name,
+					"err":        err,
+				}).Warn("change streams are not supported, polling instead")
+			pollCollection(ctx, name)
+			return
+		}
+		var cmdErr mongo.CommandError
+		if errors.As(err, &cmdErr) && cmdErr.Code == 286 {
+			// The resume token fell off the oplog, start from now
+			log.WithFields(
+				logrus.Fields{
+					"collection": name,
+				}).Warn("change stream history lost, dropping the resume token")
+			deleteResumeToken(ctx, name)
+		}
+		log.WithFields(
+			logrus.Fields{
+				"collection": name,
+				"err":        err,
+			}).Error("watch collection failed, retrying")
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(WATCH_RETRY_PERIOD):
+		}
+	}
+}
+
+func isChangeStreamUnsupported(err error) bool {
+	var cmdErr mongo.CommandError
+	if !errors.As(err, &cmdErr) {
+		return false
+	}
+	// 40573: $changeStream is only supported on replica sets
+	// 40324: unrecognized pipeline stage name $changeStream
+	return cmdErr.Code == 40573 || cmdErr.Code == 40324
+}
+
+// watchCollection handles the change stream events of the collection, and
+// persists the resume token after every event
+func watchCollection(ctx context.Context, name string) error {
+	client, err := GetMongoClient(ctx)
+	if err != nil {
+		return err
+	}
+	collection := client.Database(DB).Collection(name)
+
+	opts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+	if token := loadResumeToken(ctx, name); token != nil {
+		opts.SetResumeAfter(token)
+	}
+	stream, err := collection.Watch(ctx, mongo.Pipeline{}, opts)
+	if err != nil {
+		return err
+	}
+	defer stream.Close(context.Background())
+	log.WithFields(
+		logrus.Fields{
+			"collection": name,
+		}).Info("watching collection changes")
+
+	for stream.Next(ctx) {
+		var event struct {
+			OperationType     string `bson:"operationType"`
+			DocumentKey       bson.M `bson:"documentKey"`
+			FullDocument      bson.M `bson:"fullDocument"`
+			UpdateDescription struct {
+				UpdatedFields bson.M   `bson:"updatedFields"`
+				RemovedFields []string `bson:"removedFields"`
+			} `bson:"updateDescription"`
+		}
+		if err := stream.Decode(&event); err != nil {
+			return err
+		}
+		// The ratio refresh is the watcher's own write, the item was
+		// handled with the change which caused it
+		update := event.UpdateDescription
+		ownWrite := name == COLLECTION && event.OperationType == "update" &&
+			len(update.UpdatedFields) == 1 && update.UpdatedFields["ratio"] != nil && len(update.RemovedFields) == 0 &&
+			takeOwnRatioWrite(idKey(event.DocumentKey["_id"]))
+		if !ownWrite {
+			handleChange(ctx, ChangeEvent{
+				Collection:   name,
+				Operation:    event.OperationType,
+				DocumentKey:  event.DocumentKey["_id"],
+				FullDocument: event.FullDocument,
+			})
+		}
+		saveResumeToken(ctx, name, stream.ResumeToken())
+	}
+	return stream.Err()
+}
+
+// docHash is the hash of one document of the poll snapshot, keyed by the
+// idKey of its _id
+type docHash struct {
+	id   interface{}
+	hash int64
+}
+
+// idKey is the map key of the _id. A document or array _id isn't
+// comparable, and the extended JSON keeps the _id's type
+func idKey(id interface{}) string {
+	data, err := bson.MarshalExtJSON(bson.D{{"_id", id}}, true, false)
+	if err != nil {
+		return fmt.Sprint(id)
+	}
+	return string(data)
+}
+
+// pollCollection detects the changes of the collection by comparing the
+// hashes of all its documents on every poll interval. Only the _id and hash
+// of every document are kept, the changed documents are fetched by _id
+func pollCollection(ctx context.Context, name string) {
+	interval := time.Duration(config.Watcher.PollIntervalSeconds) * time.Second
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var previous map[string]docHash
+	for {
+		current, err := snapshotCollection(ctx, name, nil)
+		if err == nil && previous != nil {
+			// The first snapshot is the baseline
+			err = pollChanges(ctx, name, previous, current)
+		}
+		if err != nil {
+			log.WithFields(
+				logrus.Fields{
+					"collection": name,
+					"err":        err,
+				}).Error("poll collection failed")
+		} else {
+			previous = current
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// pollChanges handles the inserts, updates and deletes between the
+// snapshots. The items whose ratio it refreshed are hashed again into the
+// current snapshot, so the next poll doesn't take the watcher's own write for
+// a change
+func pollChanges(ctx context.Context, name string, previous, current map[string]docHash) error {
+	var changed bson.A
+	inserted := map[string]bool{}
+	for key, doc := range current {
+		old, ok := previous[key]
+		if !ok {
+			inserted[key] = true
+		}
+		if !ok || old.hash != doc.hash {
+			changed = append(changed, doc.id)
+		}
+	}
+
+	if len(changed) > 0 {
+		client, err := GetMongoClient(ctx)
+		if err != nil {
+			return err
+		}
+		cursor, err := client.Database(DB).Collection(name).Find(ctx, bson.M{"_id": bson.M{"$in": changed}})
+		if err != nil {
+			return err
+		}
+		var docs []bson.M
+		if err := cursor.All(ctx, &docs); err != nil {
+			return err
+		}
+		// A document deleted since the snapshot is found by the next poll
+		var rewritten bson.A
+		for _, doc := range docs {
+			key := idKey(doc["_id"])
+			operation := "update"
+			if inserted[key] {
+				operation = "insert"
+			}
+			handleChange(ctx, ChangeEvent{Collection: name, Operation: operation, DocumentKey: doc["_id"], FullDocument: doc})
+			if takeOwnRatioWrite(key) {
+				rewritten = append(rewritten, doc["_id"])
+			}
+		}
+		if len(rewritten) > 0 {
+			hashes, err := snapshotCollection(ctx, name, rewritten)
+			if err != nil {
+				return err
+			}
+			for key, doc := range hashes {
+				current[key] = doc
+			}
+		}
+	}
+	for key, doc := range previous {
+		if _, ok := current[key]; !ok {
+			handleChange(ctx, ChangeEvent{Collection: name, Operation: "delete", DocumentKey: doc.id})
+		}
+	}
+	return nil
+}
+
+// snapshotCollection gets the hash of every document of the collection, or
+// of the ids only when they're set. The cluster hashes them so only the _ids
+// and the hashes are sent
+func snapshotCollection(ctx context.Context, name string, ids bson.A) (map[string]docHash, error) {
+	client, err := GetMongoClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p := bson.A{}
+	if ids != nil {
+		p = append(p, bson.D{{"$match", bson.D{{"_id", bson.D{{"$in", ids}}}}}})
+	}
+	p = append(p, bson.D{{"$project", bson.D{
+		{"_id", 1},
+		{"hash", bson.D{{"$toHashedIndexKey", "$$ROOT"}}},
+	}}})
+	cursor, err := client.Database(DB).Collection(name).Aggregate(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	hashes := map[string]docHash{}
+	for cursor.Next(ctx) {
+		var doc struct {
+			ID   interface{} `bson:"_id"`
+			Hash int64       `bson:"hash"`
+		}
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, err
+		}
+		hashes[idKey(doc.ID)] = docHash{id: doc.ID, hash: doc.Hash}
+	}
+	return hashes, cursor.Err()
+}
+
+// handleChange refreshes the derived item fields and calls the listeners
+func handleChange(ctx context.Context, event ChangeEvent) {
+	if sampled("catalog changed") {
+		log.WithFields(
+			logrus.Fields{
+				"collection": event.Collection,
+				"operation":  event.Operation,
+				"id":         event.DocumentKey,
+			}).Info("catalog changed")
+	}
+
+	if event.Collection == COLLECTION && event.FullDocument != nil {
+		refreshRatio(ctx, event.FullDocument)
+	}
+	for _, fn := range changeListeners {
+		fn(event)
+	}
+}
+
+// ownRatioWrites are the items whose ratio the watcher has written and whose
+// change for it isn't seen yet, by the idKey of their _id
+var ownRatioWrites = struct {
+	sync.Mutex
+	keys map[string]bool
+}{keys: map[string]bool{}}
+
+// takeOwnRatioWrite tells if the watcher has written the item's ratio, and
+// forgets the write
+func takeOwnRatioWrite(key string) bool {
+	ownRatioWrites.Lock()
+	defer ownRatioWrites.Unlock()
+	ok := ownRatioWrites.keys[key]
+	delete(ownRatioWrites.keys, key)
+	return ok
+}
+
+// refreshRatio updates the item's ratio when it doesn't match the price
+// and originalPrice anymore
+func refreshRatio(ctx context.Context, doc bson.M) {
+	price, ok := numberValue(doc["price"])
+	if !ok {
+		return
+	}
+	originalPrice, ok := numberValue(doc["originalPrice"])
+	if !ok || originalPrice <= 0 {
+		return
+	}
+	ratio := price / originalPrice
+	if current, ok := numberValue(doc["ratio"]); ok && math.Abs(current-ratio) < 1e-9 {
+		return
+	}
+
+	client, err := GetMongoClient(ctx)
+	if err != nil {
+		return
+	}
+	collection := client.Database(DB).Collection(COLLECTION)
+	// Registered before the write, so its change event always finds it
+	key := idKey(doc["_id"])
+	ownRatioWrites.Lock()
+	ownRatioWrites.keys[key] = true
+	ownRatioWrites.Unlock()
+	res, err := collection.UpdateOne(ctx, bson.M{"_id": doc["_id"]}, bson.M{"$set": bson.M{"ratio": ratio}})
+	if err != nil {
+		log.WithFields(
+			logrus.Fields{
+				"documentId": doc["documentId"],
+				"err":        err,
+			}).Error("refresh item ratio failed")
+	}
+	if err != nil || res.ModifiedCount == 0 {
+		takeOwnRatioWrite(key)
+	}
+}
+
+func loadResumeToken(ctx context.Context, name string) bson.Raw {
+	client, err := GetMongoClient(ctx)
+	if err != nil {
+		return nil
+	}
+	var doc struct {
+		Token bson.Raw `bson:"token"`
+	}
+	collection := client.Database(DB).Collection(RESUME_TOKEN_COLLECTION)
+	if err := collection.FindOne(ctx, bson.M{"_id": name}).Decode(&doc); err != nil {
+		return nil
+	}
+	return doc.Token
+}
+
+func saveResumeToken(ctx context.Context, name string, token bson.Raw) {
+	client, err := GetMongoClient(ctx)
+	if err != nil || token == nil {
+		return
+	}
+	collection := client.Database(DB).Collection(RESUME_TOKEN_COLLECTION)
+	update := bson.M{"$set": bson.M{"token": token, "updatedAt": time.Now()}}
+	if _, err := collection.UpdateOne(ctx, bson.M{"_id": name}, update, options.Update().SetUpsert(true)); err != nil {
+		log.WithFields(
+			logrus.Fields{
+				"collection": name,
+				"err":        err,
+			}).Error("save resume token failed")
+	}
+}
+
+func deleteResumeToken(ctx context.Context, name string) {
+	client, err := GetMongoClient(ctx)
+	if err != nil {
+		return
+	}
+	client.Database(DB).Collection(RESUME_TOKEN_COLLECTION).DeleteOne(ctx, bson.M{"_id": name})
+}